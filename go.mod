@@ -4,25 +4,30 @@ go 1.26.1
 
 require (
 	github.com/go-co-op/gocron/v2 v2.19.1
+	github.com/nats-io/nats-server/v2 v2.12.5
 	github.com/nats-io/nats.go v1.49.0
 	github.com/open-uem/nats v0.11.1-0.20260306074514-8e457deeb739
 	github.com/open-uem/utils v0.0.0-20260306074720-edefb16dda84
-	github.com/zcalusic/sysinfo v1.1.3
-	golang.org/x/sys v0.41.0
+	golang.org/x/sys v0.42.0
 	gopkg.in/ini.v1 v1.67.1
 )
 
 require (
+	github.com/antithesishq/antithesis-sdk-go v0.6.0-default-no-op // indirect
 	github.com/danieljoos/wincred v1.2.3 // indirect
+	github.com/google/go-tpm v0.9.8 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/jonboulle/clockwork v0.5.0 // indirect
 	github.com/klauspost/compress v1.18.4 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
+	github.com/minio/highwayhash v1.0.4-0.20251030100505-070ab1a87a76 // indirect
+	github.com/nats-io/jwt/v2 v2.8.0 // indirect
 	github.com/nats-io/nkeys v0.4.15 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/open-uem/openuem-ansible-config v0.0.0-20260127123556-80a04b5821c5 // indirect
 	github.com/open-uem/wingetcfg v0.0.0-20251011111407-80e823d91ea5 // indirect
 	github.com/robfig/cron/v3 v3.0.1 // indirect
 	golang.org/x/crypto v0.48.0 // indirect
+	golang.org/x/time v0.15.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,281 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	CERTIFICATE_VALID    = "valid"
+	CERTIFICATE_EXPIRING = "expiring"
+	CERTIFICATE_EXPIRED  = "expired"
+	CERTIFICATE_INVALID  = "invalid"
+)
+
+// CertificateCheckInterval is how often the certificates are checked
+var CertificateCheckInterval = 6 * time.Hour
+
+// CertificateStatus is published on agent.updater.certificate.<AgentId> when a
+// certificate reaches a warning threshold or expires
+type CertificateStatus struct {
+	AgentID     string    `json:"agent_id"`
+	Certificate string    `json:"certificate"`
+	Path        string    `json:"path"`
+	Status      string    `json:"status"`
+	NotAfter    time.Time `json:"not_after,omitempty"`
+	DaysLeft    int       `json:"days_left"`
+	Threshold   int       `json:"threshold_days,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// CertificateMonitor remembers the last threshold reported for every
+// certificate so each warning is only sent once
+type CertificateMonitor struct {
+	Thresholds []int
+
+	mu       sync.Mutex
+	reported map[string]certificateReport
+	statuses []CertificateStatus
+	expired  bool
+}
+
+type certificateReport struct {
+	notAfter  time.Time
+	threshold int
+	status    string
+}
+
+// NewCertificateMonitor reads the warning thresholds in days from the Updater
+// section of the agent's INI file, e.g:
+//
+//	[Updater]
+//	CertificateWarningDays = 30,14,7,1
+func NewCertificateMonitor() *CertificateMonitor {
+	m := CertificateMonitor{
+		Thresholds: []int{30, 14, 7, 1},
+		reported:   map[string]certificateReport{},
+	}
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return &m
+	}
+
+	value := cfg.Section("Updater").Key("CertificateWarningDays").String()
+	if value == "" {
+		return &m
+	}
+
+	thresholds := []int{}
+	for _, d := range strings.Split(value, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(d))
+		if err != nil || days <= 0 {
+			slog.Error("could not parse certificate warning days, using defaults", "value", value)
+			return &m
+		}
+		thresholds = append(thresholds, days)
+	}
+	slices.Sort(thresholds)
+	m.Thresholds = thresholds
+
+	return &m
+}
+
+// threshold returns the smallest threshold the days left have reached, 0 if none
+func (m *CertificateMonitor) threshold(daysLeft int) int {
+	for _, t := range m.Thresholds {
+		if daysLeft <= t {
+			return t
+		}
+	}
+	return 0
+}
+
+// Check builds the status of a certificate and reports if it must be sent,
+// that's the first time it reaches a threshold, expires or can't be read
+func (m *CertificateMonitor) Check(name, path string, now time.Time) (CertificateStatus, bool) {
+	status := CertificateStatus{Certificate: name, Path: path, Status: CERTIFICATE_VALID, Timestamp: now.UTC()}
+
+	cert, err := ReadCertificate(path)
+	if err != nil {
+		status.Status = CERTIFICATE_INVALID
+		status.Error = err.Error()
+	} else {
+		status.NotAfter = cert.NotAfter
+		status.DaysLeft = int(cert.NotAfter.Sub(now).Hours() / 24)
+		switch {
+		case now.After(cert.NotAfter):
+			status.Status = CERTIFICATE_EXPIRED
+		case now.Before(cert.NotBefore):
+			status.Status = CERTIFICATE_INVALID
+			status.Error = fmt.Sprintf("the certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+		case m.threshold(status.DaysLeft) > 0:
+			status.Status = CERTIFICATE_EXPIRING
+			status.Threshold = m.threshold(status.DaysLeft)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, ok := m.reported[name]
+	report := certificateReport{notAfter: status.NotAfter, threshold: status.Threshold, status: status.Status}
+	m.reported[name] = report
+
+	// A renewed certificate starts over
+	if !ok || !previous.notAfter.Equal(report.notAfter) {
+		return status, status.Status != CERTIFICATE_VALID
+	}
+	return status, previous != report && status.Status != CERTIFICATE_VALID
+}
+
+// Statuses returns the last status of every certificate
+func (m *CertificateMonitor) Statuses() []CertificateStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.statuses)
+}
+
+// Expired reports if the agent certificate has expired
+func (m *CertificateMonitor) Expired() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.expired
+}
+
+// StartCertificateCheckJob checks the certificates every CertificateCheckInterval
+func (us *UpdaterService) StartCertificateCheckJob() error {
+	var err error
+
+	us.CertificateMonitor = NewCertificateMonitor()
+
+	us.CertificateCheckJob, err = us.TaskScheduler.NewJob(
+		gocron.DurationJob(CertificateCheckInterval),
+		gocron.NewTask(func() {
+			us.CheckCertificates()
+		}),
+		gocron.WithName("certificate-check"),
+	)
+	if err != nil {
+		return fmt.Errorf("could not start the certificate check job: %v", err)
+	}
+	slog.Info("new certificate check job has been scheduled", "every_hours", int(CertificateCheckInterval.Hours()))
+	return nil
+}
+
+// CheckCertificates checks the validity of the agent and CA certificates,
+// saves their expiry date in the INI file and warns the server when they're
+// about to expire. Once the agent certificate has expired the updater stops
+// connecting to NATS until the certificate is renewed, it reports true if it
+// has reconnected for that reason
+func (us *UpdaterService) CheckCertificates() bool {
+	now := time.Now()
+	config := us.Config()
+
+	statuses := []CertificateStatus{}
+	for _, c := range []struct{ name, path string }{{"agent", config.AgentCert}, {"ca", config.CACert}} {
+		status, report := us.CertificateMonitor.Check(c.name, c.path, now)
+		status.AgentID = us.AgentId
+		statuses = append(statuses, status)
+
+		if !report {
+			continue
+		}
+
+		switch status.Status {
+		case CERTIFICATE_EXPIRING:
+			slog.Warn("certificate is about to expire", "certificate", c.name, "path", c.path, "not_after", status.NotAfter, "days_left", status.DaysLeft)
+		case CERTIFICATE_EXPIRED:
+			slog.Error("certificate has expired", "certificate", c.name, "path", c.path, "not_after", status.NotAfter)
+		case CERTIFICATE_INVALID:
+			slog.Error("could not read certificate", "certificate", c.name, "path", c.path, "error", status.Error)
+		}
+		us.publishCertificateStatus(status)
+	}
+
+	expired := statuses[0].Status == CERTIFICATE_EXPIRED
+
+	us.CertificateMonitor.mu.Lock()
+	wasExpired := us.CertificateMonitor.expired
+	us.CertificateMonitor.statuses = statuses
+	us.CertificateMonitor.expired = expired
+	us.CertificateMonitor.mu.Unlock()
+
+	us.saveCertificateStatus(statuses)
+
+	// The server would reject us anyway, don't keep reconnecting with an expired certificate
+	if expired && !wasExpired && us.connection() != nil {
+		slog.Error("the agent certificate has expired, disconnecting from NATS until it's renewed")
+		if err := us.Reconnect(); err != nil {
+			slog.Error("could not start the NATS connect job", "error", err)
+		}
+		return true
+	}
+	return false
+}
+
+// certificateExpired reports if the agent certificate is known to have expired
+func (us *UpdaterService) certificateExpired() bool {
+	return us.CertificateMonitor != nil && us.CertificateMonitor.Expired()
+}
+
+// saveCertificateStatus records the expiry date and the status of the
+// certificates in the Certificates section of the INI file
+func (us *UpdaterService) saveCertificateStatus(statuses []CertificateStatus) {
+	err := UpdateINI(AgentConfigFile(), func(cfg *ini.File) bool {
+		changed := false
+		for _, s := range statuses {
+			prefix := "AgentCert"
+			if s.Certificate == "ca" {
+				prefix = "CACert"
+			}
+
+			expiry := ""
+			if !s.NotAfter.IsZero() {
+				expiry = s.NotAfter.Local().Format("2006-01-02T15:04:05")
+			}
+
+			section := cfg.Section("Certificates")
+			if section.Key(prefix+"Expiry").String() != expiry || section.Key(prefix+"Status").String() != s.Status {
+				section.Key(prefix + "Expiry").SetValue(expiry)
+				section.Key(prefix + "Status").SetValue(s.Status)
+				changed = true
+			}
+		}
+
+		// Don't rewrite the file, and wake up the config watcher, if nothing has changed
+		return changed
+	})
+	if err != nil {
+		slog.Error("could not save certificate status to INI file", "error", err)
+	}
+}
+
+func (us *UpdaterService) publishCertificateStatus(status CertificateStatus) {
+	nc := us.connected()
+	if nc == nil {
+		return
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		slog.Error("could not marshal certificate status", "error", err)
+		return
+	}
+
+	if err := nc.Publish("agent.updater.certificate."+us.AgentId, data); err != nil {
+		slog.Error("could not publish certificate status", "error", err)
+	}
+}
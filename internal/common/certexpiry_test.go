@@ -0,0 +1,39 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCertificateMonitorCheck(t *testing.T) {
+	pki := newTestPKI(t)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		status    string
+	}{
+		{"valid", now.Add(-time.Hour), now.Add(90 * 24 * time.Hour), CERTIFICATE_VALID},
+		{"expiring", now.Add(-time.Hour), now.Add(10 * 24 * time.Hour), CERTIFICATE_EXPIRING},
+		{"expired", now.Add(-48 * time.Hour), now.Add(-24 * time.Hour), CERTIFICATE_EXPIRED},
+		{"not yet valid", now.Add(24 * time.Hour), now.Add(48 * time.Hour), CERTIFICATE_INVALID},
+	}
+
+	for _, tt := range tests {
+		m := CertificateMonitor{Thresholds: []int{30, 14, 7, 1}, reported: map[string]certificateReport{}}
+		cert, _ := pki.issue(t, "agent", tt.notBefore, tt.notAfter, false)
+
+		status, report := m.Check("agent", cert, now)
+		if status.Status != tt.status {
+			t.Errorf("%s: got status %s, expected %s", tt.name, status.Status, tt.status)
+		}
+		if report != (tt.status != CERTIFICATE_VALID) {
+			t.Errorf("%s: report is %v", tt.name, report)
+		}
+		if _, again := m.Check("agent", cert, now); again {
+			t.Errorf("%s: the same status should only be reported once", tt.name)
+		}
+	}
+}
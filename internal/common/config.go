@@ -0,0 +1,149 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	openuem_utils "github.com/open-uem/utils"
+	"gopkg.in/ini.v1"
+)
+
+// Config holds the settings the updater needs to connect to the server
+type Config struct {
+	AgentID       string
+	NATSServers   string
+	WebsocketPort string
+	CACert        string
+	AgentCert     string
+	AgentKey      string
+}
+
+// Load reads the configuration from the agent's INI file and validates it,
+// all the problems found are returned joined in a single error. Problems that
+// don't stop the updater, like an expired certificate which the certificate
+// monitor handles, are returned as warnings. Certificates whose paths are not
+// set are read from the certificates folder in the working directory
+func Load(path string) (Config, []error, error) {
+	c := Config{}
+
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return c, nil, fmt.Errorf("could not load config file, reason: %v", err)
+	}
+
+	errs := []error{}
+
+	c.AgentID = cfg.Section("Agent").Key("UUID").String()
+	if c.AgentID == "" {
+		errs = append(errs, errors.New("the UUID key in the Agent section is required"))
+	}
+
+	c.NATSServers = cfg.Section("NATS").Key("NATSServers").String()
+	if c.NATSServers == "" {
+		errs = append(errs, errors.New("the NATSServers key in the NATS section is required"))
+	}
+
+	c.WebsocketPort = cfg.Section("NATS").Key("WebSocketPort").String()
+	if c.WebsocketPort != "" {
+		if port, err := strconv.Atoi(c.WebsocketPort); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("the WebSocket port %q is not valid", c.WebsocketPort))
+		}
+	}
+
+	c.CACert = cfg.Section("Certificates").Key("CACert").String()
+	c.AgentCert = cfg.Section("Certificates").Key("AgentCert").String()
+	c.AgentKey = cfg.Section("Certificates").Key("AgentKey").String()
+
+	if c.CACert == "" || c.AgentCert == "" || c.AgentKey == "" {
+		cwd, err := openuem_utils.GetWd()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not get current working directory, reason: %v", err))
+		} else {
+			if c.CACert == "" {
+				c.CACert = filepath.Join(cwd, "certificates", "ca.cer")
+			}
+			if c.AgentCert == "" {
+				c.AgentCert = filepath.Join(cwd, "certificates", "agent.cer")
+			}
+			if c.AgentKey == "" {
+				c.AgentKey = filepath.Join(cwd, "certificates", "agent.key")
+			}
+		}
+	}
+
+	warnings, certErrs := c.validateCertificates(time.Now())
+	errs = append(errs, certErrs...)
+
+	return c, warnings, errors.Join(errs...)
+}
+
+// validateCertificates checks that the certificates can be read and that the
+// agent certificate matches its private key. A certificate outside its
+// validity period is a warning, the certificate monitor stops connecting
+// with an expired agent certificate until it's renewed
+func (c Config) validateCertificates(now time.Time) (warnings []error, errs []error) {
+	if c.CACert != "" {
+		if cert, err := ReadCertificate(c.CACert); err != nil {
+			errs = append(errs, fmt.Errorf("could not read CA certificate, reason: %v", err))
+		} else if err := checkValidity(cert, now); err != nil {
+			warnings = append(warnings, fmt.Errorf("the CA certificate %v", err))
+		}
+	}
+
+	if c.AgentCert == "" || c.AgentKey == "" {
+		return warnings, errs
+	}
+
+	cert, err := ReadCertificate(c.AgentCert)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("could not read agent certificate, reason: %v", err))
+	} else if err := checkValidity(cert, now); err != nil {
+		warnings = append(warnings, fmt.Errorf("the agent certificate %v", err))
+	}
+
+	if _, err := os.Stat(c.AgentKey); err != nil {
+		errs = append(errs, fmt.Errorf("could not read agent private key, reason: %v", err))
+		return warnings, errs
+	}
+
+	if cert != nil {
+		if _, err := tls.LoadX509KeyPair(c.AgentCert, c.AgentKey); err != nil {
+			errs = append(errs, fmt.Errorf("the agent certificate and private key don't match, reason: %v", err))
+		}
+	}
+
+	return warnings, errs
+}
+
+// checkValidity reports a certificate that has expired or is not valid yet
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("expired on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ReadCertificate reads a PEM encoded certificate
+func ReadCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s doesn't contain a PEM certificate", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAgentID = "0a5e7d06-1c2b-4f3a-9d8e-7f6a5b4c3d2e"
+
+// configFixture is the content of an agent INI file, its certificates are
+// valid unless they're replaced
+type configFixture struct {
+	UUID        string
+	NATSServers string
+	Port        string
+	CACert      string
+	AgentCert   string
+	AgentKey    string
+}
+
+func newConfigFixture(t *testing.T, pki *testPKI) configFixture {
+	t.Helper()
+
+	cert, key := pki.issue(t, "agent", time.Now().Add(-time.Hour), time.Now().Add(time.Hour), false)
+	return configFixture{
+		UUID:        testAgentID,
+		NATSServers: "localhost:4433",
+		CACert:      pki.CACert,
+		AgentCert:   cert,
+		AgentKey:    key,
+	}
+}
+
+func (f configFixture) write(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "openuem.ini")
+	data := fmt.Sprintf(`[Agent]
+UUID = %s
+
+[NATS]
+NATSServers = %s
+WebSocketPort = %s
+
+[Certificates]
+CACert = %s
+AgentCert = %s
+AgentKey = %s
+`, f.UUID, f.NATSServers, f.Port, f.CACert, f.AgentCert, f.AgentKey)
+
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	pki := newTestPKI(t)
+	f := newConfigFixture(t, pki)
+	f.Port = "4444"
+
+	c, warnings, err := Load(f.write(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("a valid configuration has no warnings, got %v", warnings)
+	}
+
+	expected := Config{AgentID: testAgentID, NATSServers: "localhost:4433", WebsocketPort: "4444", CACert: f.CACert, AgentCert: f.AgentCert, AgentKey: f.AgentKey}
+	if c != expected {
+		t.Errorf("got config %+v", c)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	pki := newTestPKI(t)
+
+	garbage := filepath.Join(t.TempDir(), "garbage.cer")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.cer")
+	_, otherKey := pki.issue(t, "other", time.Now().Add(-time.Hour), time.Now().Add(time.Hour), false)
+
+	tests := []struct {
+		name     string
+		change   func(f *configFixture)
+		problems int
+		mentions []string
+	}{
+		{"missing UUID", func(f *configFixture) { f.UUID = "" }, 1, []string{"UUID"}},
+		{"missing NATS servers", func(f *configFixture) { f.NATSServers = "" }, 1, []string{"NATSServers"}},
+		{"port is not a number", func(f *configFixture) { f.Port = "http" }, 1, []string{"WebSocket port"}},
+		{"port out of range", func(f *configFixture) { f.Port = "70000" }, 1, []string{"WebSocket port"}},
+		{"unreadable CA certificate", func(f *configFixture) { f.CACert = missing }, 1, []string{"CA certificate"}},
+		{"invalid CA certificate", func(f *configFixture) { f.CACert = garbage }, 1, []string{"CA certificate", "PEM"}},
+		{"invalid agent certificate", func(f *configFixture) { f.AgentCert = garbage }, 1, []string{"agent certificate", "PEM"}},
+		{"unreadable agent key", func(f *configFixture) { f.AgentKey = missing }, 1, []string{"private key"}},
+		{"mismatched agent key", func(f *configFixture) { f.AgentKey = otherKey }, 1, []string{"don't match"}},
+		{"several problems", func(f *configFixture) {
+			f.UUID, f.NATSServers, f.Port, f.CACert = "", "", "0", garbage
+		}, 4, []string{"UUID", "NATSServers", "WebSocket port", "CA certificate"}},
+	}
+
+	for _, tt := range tests {
+		f := newConfigFixture(t, pki)
+		tt.change(&f)
+
+		_, _, err := Load(f.write(t))
+		if err == nil {
+			t.Errorf("%s: the configuration should be rejected", tt.name)
+			continue
+		}
+
+		for _, m := range tt.mentions {
+			if !strings.Contains(err.Error(), m) {
+				t.Errorf("%s: the error should mention %q, got %v", tt.name, m, err)
+			}
+		}
+
+		var joined interface{ Unwrap() []error }
+		if !errors.As(err, &joined) || len(joined.Unwrap()) != tt.problems {
+			t.Errorf("%s: %d problems should be joined in the error, got %v", tt.name, tt.problems, err)
+		}
+	}
+}
+
+func TestLoadWarnsAboutCertificatesOutsideTheirValidity(t *testing.T) {
+	pki := newTestPKI(t)
+
+	for name, validity := range map[string][2]time.Time{
+		"expired":       {time.Now().Add(-48 * time.Hour), time.Now().Add(-24 * time.Hour)},
+		"not yet valid": {time.Now().Add(24 * time.Hour), time.Now().Add(48 * time.Hour)},
+	} {
+		f := newConfigFixture(t, pki)
+		f.AgentCert, f.AgentKey = pki.issue(t, "agent", validity[0], validity[1], false)
+
+		_, warnings, err := Load(f.write(t))
+		if err != nil {
+			t.Errorf("%s: the configuration should load so the certificate monitor can report it: %v", name, err)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "agent certificate") {
+			t.Errorf("%s: the certificate should be reported as a warning, got %v", name, warnings)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+// ConfigPollInterval is how often the config files are checked when file
+// notifications are not available or have been missed
+var ConfigPollInterval = 30 * time.Second
+
+// ConfigWatcher detects changes in the agent config file and the certificates
+type ConfigWatcher struct {
+	mu       sync.Mutex
+	files    map[string]fileState
+	notifier io.Closer
+	debounce *time.Timer
+}
+
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// NewConfigWatcher takes a snapshot of the files to watch
+func NewConfigWatcher(paths []string) *ConfigWatcher {
+	w := ConfigWatcher{}
+	w.SetFiles(paths)
+	return &w
+}
+
+// SetFiles replaces the watched files, e.g when a certificate path changes
+func (w *ConfigWatcher) SetFiles(paths []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := map[string]fileState{}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if state, ok := w.files[p]; ok {
+			files[p] = state
+		} else {
+			files[p] = statFile(p)
+		}
+	}
+	w.files = files
+}
+
+// Files returns the watched files
+func (w *ConfigWatcher) Files() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	paths := []string{}
+	for p := range w.files {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// Changed returns the files that have been modified, created or removed since the last call
+func (w *ConfigWatcher) Changed() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changed := []string{}
+	for p, previous := range w.files {
+		current := statFile(p)
+		if current != previous {
+			w.files[p] = current
+			changed = append(changed, p)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// Close stops the file notifications
+func (w *ConfigWatcher) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.debounce != nil {
+		w.debounce.Stop()
+	}
+
+	if w.notifier != nil {
+		if err := w.notifier.Close(); err != nil {
+			slog.Error("could not stop file notifications", "error", err)
+		}
+		w.notifier = nil
+	}
+}
+
+// configFiles returns the files whose changes must be reloaded
+func (us *UpdaterService) configFiles() []string {
+	c := us.Config()
+	return []string{AgentConfigFile(), c.CACert, c.AgentCert, c.AgentKey}
+}
+
+// StartConfigWatchJob watches the config files using file notifications if
+// the OS supports them and polls them every ConfigPollInterval
+func (us *UpdaterService) StartConfigWatchJob() error {
+	var err error
+
+	us.ConfigWatcher = NewConfigWatcher(us.configFiles())
+
+	us.ConfigWatcher.notifier, err = WatchFiles(us.ConfigWatcher.Files(), us.configFilesNotified)
+	if err != nil {
+		slog.Info("file notifications are not available, config files will be polled", "error", err)
+	}
+
+	us.ConfigWatchJob, err = us.TaskScheduler.NewJob(
+		gocron.DurationJob(ConfigPollInterval),
+		gocron.NewTask(func() {
+			us.CheckConfigFiles()
+		}),
+		gocron.WithName("config-watch"),
+	)
+	if err != nil {
+		return fmt.Errorf("could not start the config watch job: %v", err)
+	}
+	slog.Info("new config watch job has been scheduled", "every_seconds", int(ConfigPollInterval.Seconds()))
+	return nil
+}
+
+// configFilesNotified waits for writes to settle before checking the files
+// as editors and the agent may write them in several steps
+func (us *UpdaterService) configFilesNotified() {
+	w := us.ConfigWatcher
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.debounce != nil {
+		w.debounce.Stop()
+	}
+	w.debounce = time.AfterFunc(time.Second, us.CheckConfigFiles)
+}
+
+// CheckConfigFiles reloads the configuration if any of the watched files has changed
+func (us *UpdaterService) CheckConfigFiles() {
+	changed := us.ConfigWatcher.Changed()
+	if len(changed) == 0 {
+		return
+	}
+
+	slog.Info("config files have changed", "files", changed)
+	us.ReloadConfig(changed)
+}
+
+// ReloadConfig validates the configuration again and applies it. If the
+// connection settings or the certificates have changed the updater
+// reconnects to NATS. An invalid configuration is ignored
+func (us *UpdaterService) ReloadConfig(changed []string) {
+	candidate, warnings, err := Load(AgentConfigFile())
+	if err != nil {
+		slog.Error("the new configuration is not valid, the current one will be kept", "error", err)
+		return
+	}
+	for _, w := range warnings {
+		slog.Warn("the new configuration has a problem", "warning", w)
+	}
+	current := us.Config()
+
+	if candidate.AgentID != current.AgentID {
+		slog.Error("the agent UUID has changed, the updater must be restarted to use it")
+		return
+	}
+
+	reconnect := candidate != current
+
+	for _, f := range changed {
+		if f == candidate.CACert || f == candidate.AgentCert || f == candidate.AgentKey {
+			reconnect = true
+		}
+	}
+
+	us.SetConfig(candidate)
+	us.HealthConfig = ReadHealthConfig()
+
+	// Certificate paths may have changed
+	files := us.ConfigWatcher.Files()
+	us.ConfigWatcher.SetFiles(us.configFiles())
+	if !slices.Equal(files, us.ConfigWatcher.Files()) {
+		us.watchConfigFiles()
+	}
+
+	if !reconnect {
+		slog.Debug("the configuration has been reloaded")
+		return
+	}
+
+	// A renewed certificate must be checked before connecting again, an
+	// expired one has already made the updater reconnect
+	if us.CertificateMonitor != nil && us.CheckCertificates() {
+		return
+	}
+
+	slog.Info("the connection settings have changed, reconnecting to NATS")
+	if err := us.Reconnect(); err != nil {
+		slog.Error("could not reconnect to NATS", "error", err)
+	}
+}
+
+// watchConfigFiles registers the file notifications again for the current files
+func (us *UpdaterService) watchConfigFiles() {
+	w := us.ConfigWatcher
+
+	w.mu.Lock()
+	if w.notifier != nil {
+		if err := w.notifier.Close(); err != nil {
+			slog.Error("could not stop file notifications", "error", err)
+		}
+		w.notifier = nil
+	}
+	w.mu.Unlock()
+
+	notifier, err := WatchFiles(w.Files(), us.configFilesNotified)
+	if err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.notifier = notifier
+	w.mu.Unlock()
+}
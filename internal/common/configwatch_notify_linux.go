@@ -0,0 +1,89 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WatchFiles uses inotify to call changed when any of the files is written,
+// created, moved or removed. The directories are watched instead of the
+// files so files replaced with a rename are still followed
+func WatchFiles(paths []string, changed func()) (io.Closer, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	// A non blocking descriptor uses the runtime poller so Close stops the reader
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	dirs := map[string]bool{}
+	names := []string{}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		names = append(names, filepath.Base(p))
+		dirs[filepath.Dir(p)] = true
+	}
+
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_ATTRIB)
+	watched := 0
+	for dir := range dirs {
+		if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+			slog.Error("could not watch directory", "path", dir, "error", err)
+			continue
+		}
+		watched++
+	}
+
+	if watched == 0 {
+		f.Close()
+		return nil, errors.New("no directory could be watched")
+	}
+
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+
+			notify := false
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + unix.SizeofInotifyEvent
+				nameEnd := nameStart + int(event.Len)
+				if nameEnd > n {
+					break
+				}
+
+				name := string(buf[nameStart:nameEnd])
+				if i := slices.Index([]byte(name), 0); i >= 0 {
+					name = name[:i]
+				}
+				if slices.Contains(names, name) || event.Mask&unix.IN_Q_OVERFLOW != 0 {
+					notify = true
+				}
+
+				offset = nameEnd
+			}
+
+			if notify {
+				changed()
+			}
+		}
+	}()
+
+	return f, nil
+}
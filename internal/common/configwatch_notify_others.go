@@ -0,0 +1,13 @@
+//go:build !linux
+
+package common
+
+import (
+	"errors"
+	"io"
+)
+
+// WatchFiles is only implemented with inotify, other systems poll the files
+func WatchFiles(paths []string, changed func()) (io.Closer, error) {
+	return nil, errors.New("file notifications are not supported on this system")
+}
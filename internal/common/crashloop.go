@@ -0,0 +1,231 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// AGENT_CRASH_LOOPING is the condition raised when the watchdog keeps finding
+// the agent stopped
+const AGENT_CRASH_LOOPING = "agent_crash_looping"
+
+// RestartTracker keeps the history of agent restarts done by the watchdog.
+// MaxRestarts restarts inside Window is a crash loop, from then on every
+// restart doubles the wait before the next one up to MaxBackoff, and after
+// MaxAttempts consecutive restarts the watchdog gives up until the agent
+// is seen running again
+type RestartTracker struct {
+	MaxRestarts int
+	Window      time.Duration
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+
+	mu           sync.Mutex
+	history      []time.Time
+	consecutive  int
+	nextAttempt  time.Time
+	crashLooping bool
+}
+
+// CrashLoopCondition is published on agent.updater.condition.<AgentId> when
+// a crash loop starts or ends
+type CrashLoopCondition struct {
+	AgentID     string     `json:"agent_id"`
+	Condition   string     `json:"condition"`
+	Active      bool       `json:"active"`
+	Restarts    int        `json:"restarts"`
+	GaveUp      bool       `json:"gave_up"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	Timestamp   time.Time  `json:"timestamp"`
+}
+
+// NewRestartTracker reads the crash loop thresholds from the Updater section
+// of the agent's INI file, using defaults for the missing keys
+func NewRestartTracker() *RestartTracker {
+	t := RestartTracker{
+		MaxRestarts: 3,
+		Window:      30 * time.Minute,
+		BaseBackoff: 5 * time.Minute,
+		MaxBackoff:  2 * time.Hour,
+		MaxAttempts: 10,
+	}
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return &t
+	}
+
+	section := cfg.Section("Updater")
+	t.MaxRestarts = section.Key("CrashLoopRestarts").MustInt(t.MaxRestarts)
+	t.Window = time.Duration(section.Key("CrashLoopWindowMinutes").MustInt(int(t.Window.Minutes()))) * time.Minute
+	t.MaxBackoff = time.Duration(section.Key("MaxRestartBackoffMinutes").MustInt(int(t.MaxBackoff.Minutes()))) * time.Minute
+	t.MaxAttempts = section.Key("MaxRestartAttempts").MustInt(t.MaxAttempts)
+
+	return &t
+}
+
+// Allow reports if the watchdog can start the agent now
+func (t *RestartTracker) Allow(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.MaxAttempts > 0 && t.consecutive >= t.MaxAttempts {
+		return false
+	}
+	return !now.Before(t.nextAttempt)
+}
+
+// Record adds a restart to the history and returns true if it has started a crash loop
+func (t *RestartTracker) Record(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.consecutive++
+	t.history = append(t.history, now)
+
+	// Keep only the restarts inside the window
+	recent := t.history[:0]
+	for _, r := range t.history {
+		if now.Sub(r) < t.Window {
+			recent = append(recent, r)
+		}
+	}
+	t.history = recent
+
+	if len(t.history) < t.MaxRestarts && !t.crashLooping {
+		return false
+	}
+
+	started := !t.crashLooping
+	t.crashLooping = true
+
+	backoff := t.BaseBackoff
+	for i := t.MaxRestarts; i < t.consecutive && backoff < t.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	t.nextAttempt = now.Add(min(backoff, t.MaxBackoff))
+
+	return started
+}
+
+// Healthy clears the crash loop once the agent has been running for a whole
+// window since the last restart, it returns true if a crash loop has ended
+func (t *RestartTracker) Healthy(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.consecutive == 0 {
+		return false
+	}
+
+	if len(t.history) > 0 && now.Sub(t.history[len(t.history)-1]) < t.Window {
+		return false
+	}
+
+	ended := t.crashLooping
+	t.consecutive = 0
+	t.history = nil
+	t.nextAttempt = time.Time{}
+	t.crashLooping = false
+	return ended
+}
+
+func (t *RestartTracker) condition(agentID string) CrashLoopCondition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := CrashLoopCondition{
+		AgentID:   agentID,
+		Condition: AGENT_CRASH_LOOPING,
+		Active:    t.crashLooping,
+		Restarts:  t.consecutive,
+		GaveUp:    t.MaxAttempts > 0 && t.consecutive >= t.MaxAttempts,
+		Timestamp: time.Now().UTC(),
+	}
+	if t.crashLooping && !c.GaveUp {
+		next := t.nextAttempt
+		c.NextAttempt = &next
+	}
+	return c
+}
+
+// CrashLooping reports if the agent is in a crash loop
+func (t *RestartTracker) CrashLooping() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.crashLooping
+}
+
+// canStartAgent is called by the watchdog when the agent is not running
+func (us *UpdaterService) canStartAgent() bool {
+	if us.RestartTracker.Allow(time.Now()) {
+		return true
+	}
+
+	c := us.RestartTracker.condition(us.AgentId)
+	if c.GaveUp {
+		slog.Error("the agent is crash looping, the watchdog gave up", "restarts", c.Restarts)
+	} else {
+		slog.Info("the agent is crash looping, waiting for the next restart attempt", "next_attempt", c.NextAttempt)
+	}
+	return false
+}
+
+// agentStarted records a restart done by the watchdog
+func (us *UpdaterService) agentStarted() {
+	started := us.RestartTracker.Record(time.Now())
+
+	c := us.RestartTracker.condition(us.AgentId)
+	switch {
+	case c.GaveUp:
+		slog.Error("the agent is crash looping, the watchdog won't start it again", "restarts", c.Restarts)
+		us.reportCrashLoop()
+	case started:
+		slog.Error("the agent is crash looping, restarts will be delayed")
+		us.reportCrashLoop()
+	}
+}
+
+// agentRunning is called by the watchdog when the agent is running
+func (us *UpdaterService) agentRunning() {
+	if us.RestartTracker.Healthy(time.Now()) {
+		slog.Info("the agent is no longer crash looping")
+		us.reportCrashLoop()
+	}
+}
+
+// reportCrashLoop writes the crash loop state to the INI file and sends it to the server
+func (us *UpdaterService) reportCrashLoop() {
+	c := us.RestartTracker.condition(us.AgentId)
+
+	err := UpdateINI(AgentConfigFile(), func(cfg *ini.File) bool {
+		cfg.Section("Agent").Key("CrashLooping").SetValue(fmt.Sprintf("%t", c.Active))
+		cfg.Section("Agent").Key("CrashLoopRestarts").SetValue(fmt.Sprintf("%d", c.Restarts))
+		return true
+	})
+	if err != nil {
+		slog.Error("could not save crash loop state to INI file", "error", err)
+	}
+
+	nc := us.connected()
+	if nc == nil {
+		return
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		slog.Error("could not marshal crash loop condition", "error", err)
+		return
+	}
+
+	if err := nc.Publish("agent.updater.condition."+us.AgentId, data); err != nil {
+		slog.Error("could not publish crash loop condition", "error", err)
+	}
+}
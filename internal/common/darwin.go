@@ -3,13 +3,10 @@
 package common
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
+	"log/slog"
 	"path/filepath"
-	"strings"
-	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go/jetstream"
@@ -19,7 +16,10 @@ import (
 
 func NewUpdateService() (*UpdaterService, error) {
 	var err error
-	us := UpdaterService{}
+	us := UpdaterService{
+		Runner:   ExecCommandRunner{},
+		Services: LaunchdServiceController{Runner: ExecCommandRunner{}},
+	}
 	us.Logger = NewLogger("openuem-updater.log")
 
 	us.TaskScheduler, err = gocron.NewScheduler()
@@ -30,84 +30,78 @@ func NewUpdateService() (*UpdaterService, error) {
 	return &us, nil
 }
 
-func ExecuteUpdate(data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) {
+func (us *UpdaterService) ExecuteUpdate(requestID string, data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) {
+	logger := slog.With("request_id", requestID)
+
 	// Download the file
 	cwd, err := openuem_utils.GetWd()
 	if err != nil {
-		log.Printf("[ERROR]: could not get working directory, reason %v", err)
-		msg.NakWithDelay(60 * time.Minute)
+		logger.Error("could not get working directory", "error", err)
+		us.RetryMessage(msg, requestID, err)
 		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not get working directory, reason %v", err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
 		return
 	}
 
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_DOWNLOADING, nil, nil, "")
+
 	// TODO - find a better place to save the agent installer and manage certificate location
 	downloadPath := filepath.Join(cwd, "updates", "agent.pkg")
 	if err := openuem_utils.DownloadFile(data.DownloadFrom, downloadPath, data.DownloadHash); err != nil {
-		log.Printf("[ERROR]: could not download update to directory, reason %v", err)
-		msg.NakWithDelay(60 * time.Minute)
+		logger.Error("could not download update to directory", "error", err)
+		us.RetryMessage(msg, requestID, err)
 		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not download update to directory, reason %v\n", err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
 		return
 	}
 
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_RESTARTING, nil, nil, "")
+
 	// Stop service
-	stopServiceCmd := "launchctl unload -w /Library/LaunchDaemons/openuem-agent.plist"
-	cmd := exec.Command("bash", "-c", stopServiceCmd)
-	if err := cmd.Run(); err != nil {
-		log.Printf("[ERROR]: could not stop the openuem-agent service, reason: %v", err)
+	if err := us.Services.Stop(AgentServiceName); err != nil {
+		logger.Error("could not stop the openuem-agent service", "error", err)
 	}
 
 	SaveTaskInfoToINI(openuem_nats.UPDATE_SUCCESS, "")
-	log.Println("[INFO]: new OpenUEM Agent update command was called", downloadPath)
+	logger.Info("new OpenUEM Agent update command was called", "path", downloadPath)
 
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not ACK message, reason: %v", err)
-	}
+	AckMessage(msg)
+
+	// The installer restarts the updater so this is the last event we can send
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_INSTALLING, nil, nil, "")
 
 	installCmd := fmt.Sprintf("installer -pkg %s -target /;launchctl kickstart -k -p system/eu.openuem.openuem-agent;launchctl kickstart -k -p system/eu.openuem.openuem-agent-updater", downloadPath)
-	err = exec.Command("bash", "-c", installCmd).Start()
-	if err != nil {
-		log.Printf("[ERROR]: could not run %s command, reason: %v", installCmd, err)
+	if err := us.Runner.Start("bash", "-c", installCmd); err != nil {
+		logger.Error("could not run install command", "command", installCmd, "error", err)
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
 		return
 	}
 }
 
-func UninstallAgent() error {
-	// Start uninstall daemon
-	log.Println("[INFO]: a request to uninstall OpenUEM Agent has been received")
-	uninstallCmd := "launchctl load -F /Library/LaunchDaemons/openuem-agent-uninstaller.plist"
-	out, err := exec.Command("bash", "-c", uninstallCmd).CombinedOutput()
-	if err != nil {
-		log.Printf("[ERROR]: could not run uninstall daemon, reason: %s", string(out))
-		return err
-	}
-	log.Println("[INFO]: launchctl command has been executed")
-	return nil
+func LogDir() (string, error) {
+	return "/var/log/openuem-agent", nil
 }
 
-func NewLogger(logFilename string) *openuem_utils.OpenUEMLogger {
-	var err error
-
-	logger := openuem_utils.OpenUEMLogger{}
-
-	// Get executable path to store logs
-	wd := "/var/log/openuem-agent"
+// GetStateDir returns the directory where the updater keeps its state files
+func GetStateDir() (string, error) {
+	return "/Library/Application Support/OpenUEM Agent/updater", nil
+}
 
-	if _, err := os.Stat(wd); os.IsNotExist(err) {
-		if err := os.MkdirAll(wd, 0660); err != nil {
-			log.Fatalf("[FATAL]: could not create log directory, reason: %v", err)
-		}
-	}
+// InstalledAgentVersion is not available as the installer doesn't register
+// the agent version, updates are always applied
+func (us *UpdaterService) InstalledAgentVersion() (string, error) {
+	return "", errors.ErrUnsupported
+}
 
-	logPath := filepath.Join(wd, logFilename)
-	logger.LogFile, err = os.Create(logPath)
+func (us *UpdaterService) UninstallAgent() error {
+	// Start uninstall daemon
+	slog.Info("a request to uninstall OpenUEM Agent has been received")
+	uninstallCmd := "launchctl load -F /Library/LaunchDaemons/openuem-agent-uninstaller.plist"
+	out, err := us.Runner.Run("bash", "-c", uninstallCmd)
 	if err != nil {
-		log.Fatalf("could not create log file,: %v", err)
+		slog.Error("could not run uninstall daemon", "output", string(out))
+		return err
 	}
-
-	logPrefix := strings.TrimSuffix(filepath.Base(logFilename), filepath.Ext(logFilename))
-	log.SetOutput(logger.LogFile)
-	log.SetPrefix(logPrefix + ": ")
-	log.SetFlags(log.Ldate | log.Ltime)
-
-	return &logger
+	slog.Info("launchctl command has been executed")
+	return nil
 }
@@ -0,0 +1,269 @@
+//go:build linux
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeferredRunCommand is the argument that makes the updater binary run a
+// deferred job instead of starting the service
+const DeferredRunCommand = "deferred-run"
+
+// DeferredJob is a command stored as an argument vector to be run later by
+// the updater binary, detached from the updater service
+type DeferredJob struct {
+	ID   string   `json:"id"`
+	Args []string `json:"args"`
+}
+
+var unitNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// NewDeferredRunner uses a systemd transient unit named after the job when
+// systemd is running and falls back to at otherwise. The runner is used for
+// the systemd commands
+func NewDeferredRunner(runner CommandRunner, unit string) DeferredRunner {
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		unit = unitNameUnsafe.ReplaceAllString(unit, "")
+		if len(unit) > 128 {
+			unit = unit[:128]
+		}
+		return &SystemdCommandRunner{Unit: unit, Runner: runner}
+	}
+	return &AtCommandRunner{}
+}
+
+// SystemdCommandRunner runs a command as a systemd transient unit. The unit
+// remains after the command exits so its result and journal can be read
+type SystemdCommandRunner struct {
+	Unit   string
+	Runner CommandRunner
+}
+
+func (r *SystemdCommandRunner) Run(name string, arg ...string) ([]byte, error) {
+	// Remove a unit left by a previous run with the same name
+	r.cleanup()
+
+	args := []string{
+		"--unit=" + r.Unit,
+		"--description=OpenUEM agent package operation",
+		"--property=Type=oneshot",
+		"--property=RemainAfterExit=yes",
+		"--no-block",
+		"--quiet",
+		"--",
+		name,
+	}
+	return r.Runner.Run("systemd-run", append(args, arg...)...)
+}
+
+func (r *SystemdCommandRunner) Wait(timeout time.Duration) (DeferredJobResult, error) {
+	result := DeferredJobResult{}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		props, err := r.show("ActiveState", "Job", "ExecMainStartTimestamp", "ExecMainStatus", "ExecMainCode", "InvocationID")
+		if err != nil {
+			return result, err
+		}
+
+		if unitFinished(props) {
+			result.FinishedAt = time.Now()
+			result.ExitCode, _ = strconv.Atoi(props["ExecMainStatus"])
+
+			// ExecMainCode 1 means the process exited, anything else is a signal or a start failure
+			if props["ExecMainCode"] != "1" && result.ExitCode == 0 {
+				result.ExitCode = -1
+			}
+
+			if props["InvocationID"] != "" {
+				out, _ := r.Runner.Run("journalctl", "_SYSTEMD_INVOCATION_ID="+props["InvocationID"], "-o", "cat", "--no-pager")
+				result.Output = string(out)
+			}
+
+			r.cleanup()
+			return result, nil
+		}
+
+		if time.Now().After(deadline) {
+			return result, fmt.Errorf("unit %s is still running after %s", r.Unit, timeout)
+		}
+		time.Sleep(VerifyPollInterval)
+	}
+}
+
+// unitFinished reports if a oneshot unit has run its command. systemd-run
+// --no-block returns once the start job is queued, so the unit is inactive
+// with a pending job until it starts and it's activating while the command runs
+func unitFinished(props map[string]string) bool {
+	started := props["InvocationID"] != "" || props["ExecMainStartTimestamp"] != ""
+	return started && props["Job"] == "" && props["ActiveState"] != "activating"
+}
+
+func (r *SystemdCommandRunner) show(property ...string) (map[string]string, error) {
+	out, err := r.Runner.Run("systemctl", "show", r.Unit, "--property="+strings.Join(property, ","))
+	if err != nil {
+		return nil, fmt.Errorf("could not get the state of unit %s, reason: %v", r.Unit, err)
+	}
+
+	props := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if key, value, found := strings.Cut(line, "="); found {
+			props[key] = value
+		}
+	}
+	return props, nil
+}
+
+func (r *SystemdCommandRunner) cleanup() {
+	_, _ = r.Runner.Run("systemctl", "stop", r.Unit)
+	_, _ = r.Runner.Run("systemctl", "reset-failed", r.Unit)
+}
+
+// AtCommandRunner queues a command with at so it runs detached from the
+// updater process one minute later. The at job only calls the updater with
+// the path of a job file holding the arguments, so they're never parsed by a shell
+type AtCommandRunner struct {
+	job string
+}
+
+func (r *AtCommandRunner) Run(name string, arg ...string) ([]byte, error) {
+	var err error
+
+	// Silverblue and Kinoite ship at without the sequence file
+	if IsOSTreeBooted() {
+		if f, err := os.OpenFile("/var/spool/at/.SEQ", os.O_CREATE, 0600); err == nil {
+			f.Close()
+		}
+	}
+
+	r.job, err = NewDeferredJob(append([]string{name}, arg...))
+	if err != nil {
+		return nil, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("at", "now", "+1", "minute")
+	cmd.Stdin = strings.NewReader(shellQuote(exe) + " " + DeferredRunCommand + " " + shellQuote(r.job) + "\n")
+	return cmd.CombinedOutput()
+}
+
+// Wait polls for the result file written by RunDeferredJob
+func (r *AtCommandRunner) Wait(timeout time.Duration) (DeferredJobResult, error) {
+	result := DeferredJobResult{}
+	if r.job == "" {
+		return result, errors.New("no deferred job has been queued")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		data, err := os.ReadFile(r.job + ".result")
+		if err == nil {
+			if err := json.Unmarshal(data, &result); err != nil {
+				return result, fmt.Errorf("could not parse deferred job result, reason: %v", err)
+			}
+			_ = os.Remove(r.job + ".result")
+			return result, nil
+		}
+
+		if time.Now().After(deadline) {
+			return result, fmt.Errorf("deferred job %s has not finished after %s, is atd running?", filepath.Base(r.job), timeout)
+		}
+		time.Sleep(VerifyPollInterval)
+	}
+}
+
+// shellQuote quotes a path we control so at's shell takes it literally
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// NewDeferredJob stores the command in a job file and returns its path
+func NewDeferredJob(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("deferred job has no command")
+	}
+
+	stateDir, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	job := DeferredJob{ID: hex.EncodeToString(id), Args: args}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(stateDir, "jobs", job.ID+".json")
+	if err := WriteStateFile(path, data); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// RunDeferredJob runs the command stored in a job file without a shell and
+// saves its exit code and output
+func RunDeferredJob(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read deferred job, reason: %v", err)
+	}
+
+	job := DeferredJob{}
+	if err := json.Unmarshal(data, &job); err != nil {
+		return fmt.Errorf("could not parse deferred job, reason: %v", err)
+	}
+
+	if len(job.Args) == 0 {
+		return errors.New("deferred job has no command")
+	}
+
+	result := DeferredJobResult{}
+	out, runErr := exec.Command(job.Args[0], job.Args[1:]...).CombinedOutput()
+	result.Output = string(out)
+	result.FinishedAt = time.Now()
+	if runErr != nil {
+		result.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		}
+	}
+
+	data, err = json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteStateFile(path+".result", data); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	return runErr
+}
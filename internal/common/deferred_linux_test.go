@@ -0,0 +1,56 @@
+//go:build linux
+
+package common
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnitFinished(t *testing.T) {
+	tests := []struct {
+		name     string
+		props    map[string]string
+		finished bool
+	}{
+		{"start job queued", map[string]string{"ActiveState": "inactive", "Job": "1234"}, false},
+		{"not started yet", map[string]string{"ActiveState": "inactive"}, false},
+		{"running", map[string]string{"ActiveState": "activating", "InvocationID": "abc", "ExecMainStartTimestamp": "Mon 2026-10-12 10:00:00 UTC"}, false},
+		{"succeeded", map[string]string{"ActiveState": "active", "InvocationID": "abc", "ExecMainStartTimestamp": "Mon 2026-10-12 10:00:00 UTC", "ExecMainCode": "1", "ExecMainStatus": "0"}, true},
+		{"failed", map[string]string{"ActiveState": "failed", "InvocationID": "abc", "ExecMainStartTimestamp": "Mon 2026-10-12 10:00:00 UTC", "ExecMainCode": "1", "ExecMainStatus": "100"}, true},
+		{"could not start", map[string]string{"ActiveState": "failed", "InvocationID": "abc"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := unitFinished(tt.props); got != tt.finished {
+			t.Errorf("%s: got finished %t, expected %t", tt.name, got, tt.finished)
+		}
+	}
+}
+
+func TestSystemdCommandRunner(t *testing.T) {
+	runner := &RecordingCommandRunner{Outputs: map[string]string{
+		"systemctl show openuem-agent-update-1 --property=ActiveState,Job,ExecMainStartTimestamp,ExecMainStatus,ExecMainCode,InvocationID": "ActiveState=failed\nJob=\nExecMainStartTimestamp=Sat 2026-10-17 10:00:00 UTC\nExecMainStatus=100\nExecMainCode=1\nInvocationID=abc\n",
+		"journalctl _SYSTEMD_INVOCATION_ID=abc -o cat --no-pager":                                                                          "E: Unable to locate package openuem-agent\n",
+	}}
+	r := SystemdCommandRunner{Unit: "openuem-agent-update-1", Runner: runner}
+
+	if _, err := r.Run("apt", "install", "-y", "openuem-agent"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Wait(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 100 || !strings.Contains(result.Output, "Unable to locate package") {
+		t.Errorf("got result %+v", result)
+	}
+
+	run := "systemd-run --unit=openuem-agent-update-1 --description=OpenUEM agent package operation --property=Type=oneshot --property=RemainAfterExit=yes --no-block --quiet -- apt install -y openuem-agent"
+	if !slices.Contains(runner.Commands(), run) {
+		t.Errorf("the unit hasn't been started with %q, commands: %q", run, runner.Commands())
+	}
+}
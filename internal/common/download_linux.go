@@ -0,0 +1,182 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	openuem_nats "github.com/open-uem/nats"
+	openuem_utils "github.com/open-uem/utils"
+	"gopkg.in/ini.v1"
+)
+
+// Package sources for Linux updates
+const (
+	PACKAGE_SOURCE_REPOSITORY = "repository"
+	PACKAGE_SOURCE_DOWNLOAD   = "download"
+)
+
+// ReadPackageSource reads where Linux updates come from. With
+//
+//	[Updater]
+//	PackageSource = download
+//
+// the package is downloaded from the URL sent in the update request
+// instead of installed from the configured repositories. The packages must be
+// signed with a key embedded in the updater or one of the keys listed in
+// PackageSigningKey (comma separated paths), which are only trusted next to
+// the embedded ones
+func ReadPackageSource() (source string, extraKeys []string) {
+	source = PACKAGE_SOURCE_REPOSITORY
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return
+	}
+
+	if cfg.Section("Updater").Key("PackageSource").String() == PACKAGE_SOURCE_DOWNLOAD {
+		source = PACKAGE_SOURCE_DOWNLOAD
+	}
+
+	extraKeys = cfg.Section("Updater").Key("PackageSigningKey").Strings(",")
+
+	return
+}
+
+// AgentPackagesDir returns the directory in the state directory where the
+// downloaded packages are kept
+var AgentPackagesDir = func() (string, error) {
+	stateDir, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "updates"), nil
+}
+
+func agentPackagesDir() (string, error) {
+	updatesDir, err := AgentPackagesDir()
+	if err != nil {
+		return "", fmt.Errorf("could not get the updates directory, reason %v", err)
+	}
+
+	if err := os.MkdirAll(updatesDir, 0700); err != nil {
+		return "", fmt.Errorf("could not create updates directory, reason %v", err)
+	}
+
+	return updatesDir, nil
+}
+
+// DownloadAgentPackage downloads the agent package, checks its hash and the
+// detached signature published next to it (<url>.sig) and returns its path.
+// The package and its signature are kept so a later update can roll back to
+// this version without a repository
+func DownloadAgentPackage(data openuem_nats.OpenUEMUpdateRequest, extension string, extraKeys []string) (string, error) {
+	if data.DownloadFrom == "" || data.DownloadHash == "" {
+		return "", Permanent(errors.New("the update request has no download URL or hash"))
+	}
+
+	keys, err := TrustedSigningKeys(extraKeys)
+	if err != nil {
+		return "", err
+	}
+
+	updatesDir, err := agentPackagesDir()
+	if err != nil {
+		return "", err
+	}
+
+	name := AgentPackage
+	if data.Version != "" {
+		name += "-" + data.Version
+	}
+
+	downloadPath := filepath.Join(updatesDir, name+extension)
+	if err := openuem_utils.DownloadFile(data.DownloadFrom, downloadPath, data.DownloadHash); err != nil {
+		os.Remove(downloadPath)
+		return "", fmt.Errorf("could not download update to directory, reason %v", err)
+	}
+
+	signature, err := DownloadSignature(data.DownloadFrom + ".sig")
+	if err != nil {
+		os.Remove(downloadPath)
+		return "", err
+	}
+
+	if err := VerifyFileSignature(downloadPath, signature, keys); err != nil {
+		os.Remove(downloadPath)
+		return "", err
+	}
+
+	if err := os.WriteFile(downloadPath+".sig", signature, 0600); err != nil {
+		slog.Warn("could not keep the package signature, rollback to this version won't be possible", "error", err)
+	}
+
+	return downloadPath, nil
+}
+
+// LocalAgentPackage returns a package kept from a previous download matching
+// the version, its signature is checked again before it's used
+func LocalAgentPackage(version, extension string, extraKeys []string) (string, error) {
+	keys, err := TrustedSigningKeys(extraKeys)
+	if err != nil {
+		return "", err
+	}
+
+	updatesDir, err := agentPackagesDir()
+	if err != nil {
+		return "", err
+	}
+
+	packages, err := filepath.Glob(filepath.Join(updatesDir, AgentPackage+"-*"+extension))
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range packages {
+		packageVersion := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), AgentPackage+"-"), extension)
+		if !VersionMatches(version, packageVersion) {
+			continue
+		}
+
+		signature, err := os.ReadFile(p + ".sig")
+		if err != nil {
+			continue
+		}
+		if err := VerifyFileSignature(p, signature, keys); err != nil {
+			slog.Warn("ignoring a local package with an invalid signature", "package", p, "error", err)
+			continue
+		}
+		return p, nil
+	}
+
+	return "", fmt.Errorf("there's no downloaded package for version %s", version)
+}
+
+// PruneAgentPackages removes the downloaded packages but the ones matching
+// the given versions
+func PruneAgentPackages(extension string, keep ...string) {
+	updatesDir, err := agentPackagesDir()
+	if err != nil {
+		return
+	}
+
+	packages, err := filepath.Glob(filepath.Join(updatesDir, AgentPackage+"*"+extension))
+	if err != nil {
+		return
+	}
+
+	for _, p := range packages {
+		packageVersion := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), AgentPackage+"-"), extension)
+		if slices.ContainsFunc(keep, func(v string) bool { return v != "" && VersionMatches(v, packageVersion) }) {
+			continue
+		}
+		os.Remove(p)
+		os.Remove(p + ".sig")
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package common
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalAgentPackage(t *testing.T) {
+	embedSigningKey(t)
+	key, private := writeSigningKey(t, t.TempDir(), "trusted.pub")
+
+	updatesDir := filepath.Join(t.TempDir(), "updates")
+	packagesDir := AgentPackagesDir
+	AgentPackagesDir = func() (string, error) { return updatesDir, nil }
+	t.Cleanup(func() { AgentPackagesDir = packagesDir })
+
+	if _, err := agentPackagesDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	writePackage := func(version string, signed bool) string {
+		path := filepath.Join(updatesDir, AgentPackage+"-"+version+".deb")
+		data := []byte("package " + version)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, ed25519.SignatureSize)
+		if signed {
+			signature = ed25519.Sign(private, data)
+		}
+		if err := os.WriteFile(path+".sig", signature, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	previous := writePackage("1.2.3", true)
+	writePackage("1.2.4", false)
+	writePackage("1.2.5", true)
+
+	path, err := LocalAgentPackage("1.2.3-1", ".deb", []string{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != previous {
+		t.Errorf("got package %s, expected %s", path, previous)
+	}
+
+	if _, err := LocalAgentPackage("1.2.4-1", ".deb", []string{key}); err == nil {
+		t.Error("a package with an invalid signature should not be used")
+	}
+
+	if _, err := LocalAgentPackage("1.2.3-1", ".deb", nil); err == nil {
+		t.Error("a package signed with an untrusted key should not be used")
+	}
+
+	PruneAgentPackages(".deb", "1.2.5")
+
+	remaining, err := filepath.Glob(filepath.Join(updatesDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 || filepath.Base(remaining[0]) != "openuem-agent-1.2.5.deb" {
+		t.Errorf("the packages left after pruning are %q", remaining)
+	}
+}
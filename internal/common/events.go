@@ -0,0 +1,198 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Phases reported in update status events
+const (
+	UPDATE_PHASE_RECEIVED    = "received"
+	UPDATE_PHASE_SCHEDULED   = "scheduled"
+	UPDATE_PHASE_CANCELLED   = "cancelled"
+	UPDATE_PHASE_DOWNLOADING = "downloading"
+	UPDATE_PHASE_INSTALLING  = "installing"
+	UPDATE_PHASE_RESTARTING  = "restarting"
+	UPDATE_PHASE_VERIFYING   = "verifying"
+	UPDATE_PHASE_SUCCEEDED   = "succeeded"
+	UPDATE_PHASE_FAILED      = "failed"
+	UPDATE_PHASE_ROLLED_BACK = "rolled_back"
+)
+
+// MaxOutboxEvents is the number of events kept while NATS is not available,
+// the oldest events are discarded first
+const MaxOutboxEvents = 500
+
+// UpdateStatusEvent is published on agent.update.status.<AgentId> every
+// time an update changes its phase
+type UpdateStatusEvent struct {
+	AgentID          string     `json:"agent_id"`
+	RequestID        string     `json:"request_id"`
+	Phase            string     `json:"phase"`
+	Timestamp        time.Time  `json:"timestamp"`
+	ScheduledAt      *time.Time `json:"scheduled_at,omitempty"`
+	Error            string     `json:"error,omitempty"`
+	InstalledVersion string     `json:"installed_version,omitempty"`
+}
+
+// EventOutbox keeps the events that couldn't be published in a state file
+// until the NATS connection is back
+type EventOutbox struct {
+	path   string
+	mu     sync.Mutex
+	events []UpdateStatusEvent
+}
+
+// LoadEventOutbox reads the pending events from path
+func LoadEventOutbox(path string) (*EventOutbox, error) {
+	o := EventOutbox{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &o, nil
+		}
+		return &o, fmt.Errorf("could not read event outbox, reason: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &o.events); err != nil {
+		return &o, fmt.Errorf("could not parse event outbox, reason: %v", err)
+	}
+
+	return &o, nil
+}
+
+// Add stores an event to be published later
+func (o *EventOutbox) Add(e UpdateStatusEvent) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = append(o.events, e)
+	if len(o.events) > MaxOutboxEvents {
+		o.events = o.events[len(o.events)-MaxOutboxEvents:]
+	}
+	return o.save()
+}
+
+// Len returns the number of events waiting to be published
+func (o *EventOutbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.events)
+}
+
+// Flush publishes the pending events in order and stops at the first failure
+func (o *EventOutbox) Flush(publish func(UpdateStatusEvent) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.events) == 0 {
+		return nil
+	}
+
+	sent := 0
+	var err error
+	for _, e := range o.events {
+		if err = publish(e); err != nil {
+			break
+		}
+		sent++
+	}
+
+	o.events = o.events[sent:]
+	if saveErr := o.save(); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+func (o *EventOutbox) save() error {
+	data, err := json.Marshal(o.events)
+	if err != nil {
+		return err
+	}
+	return WriteStateFile(o.path, data)
+}
+
+// LoadEventOutbox reads the events that were not published before the updater stopped
+func (us *UpdaterService) LoadEventOutbox() {
+	path, err := StateFile("event-outbox.json")
+	if err != nil {
+		slog.Error("the event outbox can't be stored", "error", err)
+	}
+
+	us.EventOutbox, err = LoadEventOutbox(path)
+	if err != nil {
+		slog.Error("could not load the event outbox", "error", err)
+	}
+}
+
+// PublishUpdateStatus sends an update status event to the server, the event
+// is stored in the outbox if NATS is not connected
+func (us *UpdaterService) PublishUpdateStatus(requestID, phase string, scheduledAt *time.Time, err error, installedVersion string) {
+	e := UpdateStatusEvent{
+		AgentID:          us.AgentId,
+		RequestID:        requestID,
+		Phase:            phase,
+		Timestamp:        time.Now().UTC(),
+		ScheduledAt:      scheduledAt,
+		InstalledVersion: installedVersion,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	slog.Debug("update status has changed", "request_id", requestID, "phase", phase, "error", e.Error)
+
+	us.recordRequest(requestID, "", requestState(phase))
+
+	if us.connected() != nil {
+		if err := us.FlushEventOutbox(); err == nil {
+			if err := us.publishUpdateStatusEvent(e); err == nil {
+				return
+			}
+		}
+	}
+
+	if us.EventOutbox == nil {
+		slog.Error("could not publish update status event", "request_id", requestID, "phase", phase)
+		return
+	}
+
+	if err := us.EventOutbox.Add(e); err != nil {
+		slog.Error("could not store update status event in the outbox", "request_id", requestID, "phase", phase, "error", err)
+	}
+}
+
+// FlushEventOutbox publishes the events stored while NATS was not available
+func (us *UpdaterService) FlushEventOutbox() error {
+	if us.EventOutbox == nil {
+		return nil
+	}
+
+	if err := us.EventOutbox.Flush(us.publishUpdateStatusEvent); err != nil {
+		slog.Error("could not flush the event outbox", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (us *UpdaterService) publishUpdateStatusEvent(e UpdateStatusEvent) error {
+	nc := us.connected()
+	if nc == nil {
+		return nats.ErrConnectionClosed
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return nc.Publish("agent.update.status."+us.AgentId, data)
+}
@@ -0,0 +1,246 @@
+package common
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// RecordingCommandRunner is a ProcessRunner that records the commands instead
+// of running them. Outputs and Errors are looked up by the command line
+type RecordingCommandRunner struct {
+	Outputs map[string]string
+	Errors  map[string]error
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func (r *RecordingCommandRunner) Run(name string, arg ...string) ([]byte, error) {
+	output, err := r.record(name, arg...)
+	return []byte(output), err
+}
+
+func (r *RecordingCommandRunner) Start(name string, arg ...string) error {
+	_, err := r.record(name, arg...)
+	return err
+}
+
+func (r *RecordingCommandRunner) record(name string, arg ...string) (string, error) {
+	command := strings.Join(append([]string{name}, arg...), " ")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, command)
+	return r.Outputs[command], r.Errors[command]
+}
+
+// SetOutput changes the output of a command, e.g the installed version once
+// an install has run
+func (r *RecordingCommandRunner) SetOutput(command, output string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Outputs == nil {
+		r.Outputs = map[string]string{}
+	}
+	r.Outputs[command] = output
+}
+
+// Commands returns the command lines run so far
+func (r *RecordingCommandRunner) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.commands)
+}
+
+// FakeServiceController keeps the state of the services in memory and
+// records the actions requested. Errors are looked up by "<action> <service>"
+type FakeServiceController struct {
+	Errors map[string]error
+
+	mu      sync.Mutex
+	running map[string]bool
+	actions []string
+}
+
+// NewFakeServiceController returns a controller where the services are running
+func NewFakeServiceController(running ...string) *FakeServiceController {
+	c := FakeServiceController{running: map[string]bool{}}
+	for _, s := range running {
+		c.running[s] = true
+	}
+	return &c
+}
+
+func (c *FakeServiceController) Start(service string) error {
+	return c.set("start", service, true)
+}
+
+func (c *FakeServiceController) Stop(service string) error {
+	return c.set("stop", service, false)
+}
+
+func (c *FakeServiceController) Running(service string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.running[service]
+}
+
+func (c *FakeServiceController) set(action, service string, running bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.actions = append(c.actions, action+" "+service)
+	if err := c.Errors[action+" "+service]; err != nil {
+		return err
+	}
+	c.running[service] = running
+	return nil
+}
+
+// Actions returns the actions requested so far, e.g "stop openuem-agent"
+func (c *FakeServiceController) Actions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.actions)
+}
+
+// FakeDeferredRunner records the deferred commands and returns Result when
+// waited for, after calling OnWait if it's set
+type FakeDeferredRunner struct {
+	RecordingCommandRunner
+	Result DeferredJobResult
+	OnWait func()
+}
+
+func (r *FakeDeferredRunner) Wait(timeout time.Duration) (DeferredJobResult, error) {
+	if r.OnWait != nil {
+		r.OnWait()
+	}
+	return r.Result, nil
+}
+
+// FakeMsg is a JetStream message that records how it has been acknowledged
+type FakeMsg struct {
+	subject      string
+	data         []byte
+	headers      nats.Header
+	numDelivered uint64
+
+	mu      sync.Mutex
+	actions []string
+	done    chan struct{}
+}
+
+// NewFakeMsg returns a message delivered numDelivered times, the request ID
+// is sent in the Nats-Msg-Id header if it's set
+func NewFakeMsg(subject, requestID string, data []byte, numDelivered uint64) *FakeMsg {
+	m := FakeMsg{subject: subject, data: data, headers: nats.Header{}, numDelivered: numDelivered, done: make(chan struct{})}
+	if requestID != "" {
+		m.headers.Set(jetstream.MsgIDHeader, requestID)
+	}
+	return &m
+}
+
+func (m *FakeMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return &jetstream.MsgMetadata{NumDelivered: m.numDelivered}, nil
+}
+
+func (m *FakeMsg) Data() []byte         { return m.data }
+func (m *FakeMsg) Headers() nats.Header { return m.headers }
+func (m *FakeMsg) Subject() string      { return m.subject }
+func (m *FakeMsg) Reply() string        { return "" }
+
+func (m *FakeMsg) Ack() error                          { return m.finish("ack") }
+func (m *FakeMsg) DoubleAck(ctx context.Context) error { return m.finish("ack") }
+func (m *FakeMsg) Nak() error                          { return m.finish("nak") }
+func (m *FakeMsg) Term() error                         { return m.finish("term") }
+
+func (m *FakeMsg) NakWithDelay(delay time.Duration) error {
+	return m.finish("nak " + delay.String())
+}
+
+func (m *FakeMsg) TermWithReason(reason string) error {
+	return m.finish("term " + reason)
+}
+
+func (m *FakeMsg) InProgress() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.actions = append(m.actions, "in progress")
+	return nil
+}
+
+// finish records an action that ends the delivery, only the first one counts
+func (m *FakeMsg) finish(action string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.actions = append(m.actions, action)
+	select {
+	case <-m.done:
+		return jetstream.ErrMsgAlreadyAckd
+	default:
+		close(m.done)
+	}
+	return nil
+}
+
+// Actions returns the acknowledgements received so far, e.g "nak 5m0s"
+func (m *FakeMsg) Actions() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.actions)
+}
+
+// WaitDone waits until the delivery has been acked, naked or terminated and
+// returns the action
+func (m *FakeMsg) WaitDone(t *testing.T, timeout time.Duration) string {
+	t.Helper()
+
+	select {
+	case <-m.done:
+	case <-time.After(timeout):
+		t.Fatalf("the message hasn't been acknowledged after %s, actions: %q", timeout, m.Actions())
+	}
+
+	for _, a := range m.Actions() {
+		if a != "in progress" {
+			return a
+		}
+	}
+	return ""
+}
+
+// Eventually polls condition until it's true or fails the test after timeout
+func Eventually(t *testing.T, timeout time.Duration, condition func() bool, format string, args ...any) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var (
+	_ ProcessRunner     = (*RecordingCommandRunner)(nil)
+	_ ServiceController = (*FakeServiceController)(nil)
+	_ DeferredRunner    = (*FakeDeferredRunner)(nil)
+	_ jetstream.Msg     = (*FakeMsg)(nil)
+)
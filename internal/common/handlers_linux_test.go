@@ -0,0 +1,464 @@
+//go:build linux
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go"
+	openuem_nats "github.com/open-uem/nats"
+	"gopkg.in/ini.v1"
+)
+
+const aptInstalledVersion = "dpkg-query -W -f=${Version} openuem-agent"
+
+// handlerTest is an updater running on a Debian system with fake commands,
+// services and messages, and its state and INI file in a temporary directory
+type handlerTest struct {
+	us       *UpdaterService
+	ini      string
+	runner   *RecordingCommandRunner
+	deferred *FakeDeferredRunner
+	services *FakeServiceController
+}
+
+func newHandlerTest(t *testing.T, installedVersion, iniData string) *handlerTest {
+	t.Helper()
+
+	dir := t.TempDir()
+	h := handlerTest{
+		ini:      filepath.Join(dir, "openuem.ini"),
+		runner:   &RecordingCommandRunner{Outputs: map[string]string{aptInstalledVersion: installedVersion}},
+		deferred: &FakeDeferredRunner{},
+		services: NewFakeServiceController(AgentServiceName),
+	}
+
+	if err := os.WriteFile(h.ini, []byte("[Agent]\nUUID = "+testAgentID+"\n"+iniData), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configFile, installWindow, gracePeriod, pollInterval := AgentConfigFile, InstallWindow, ServiceGracePeriod, VerifyPollInterval
+	AgentConfigFile = func() string { return h.ini }
+	InstallWindow, ServiceGracePeriod, VerifyPollInterval = time.Second, 0, 10*time.Millisecond
+	t.Cleanup(func() {
+		AgentConfigFile, InstallWindow, ServiceGracePeriod, VerifyPollInterval = configFile, installWindow, gracePeriod, pollInterval
+	})
+
+	scheduler, err := gocron.NewScheduler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	t.Cleanup(func() { _ = scheduler.Shutdown() })
+
+	h.us = &UpdaterService{
+		AgentId:       testAgentID,
+		TaskScheduler: scheduler,
+		Runner:        h.runner,
+		Services:      h.services,
+		DeferredRunners: func(unit string) DeferredRunner {
+			return h.deferred
+		},
+		OSRelease: func() (map[string]string, error) {
+			return map[string]string{"ID": "debian"}, nil
+		},
+		OSTreeBooted: func() bool {
+			return false
+		},
+	}
+
+	if h.us.RequestLedger, err = LoadRequestLedger(filepath.Join(dir, "requests.json")); err != nil {
+		t.Fatal(err)
+	}
+	if h.us.UpdateQueue, err = LoadUpdateQueue(filepath.Join(dir, "scheduled-updates.json")); err != nil {
+		t.Fatal(err)
+	}
+	if h.us.EventOutbox, err = LoadEventOutbox(filepath.Join(dir, "event-outbox.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	return &h
+}
+
+// installs the new version when the deferred install is waited for
+func (h *handlerTest) installs(version string) {
+	h.deferred.OnWait = func() {
+		h.runner.SetOutput(aptInstalledVersion, version)
+	}
+}
+
+func (h *handlerTest) update(t *testing.T, requestID string, request any, numDelivered uint64) *FakeMsg {
+	t.Helper()
+
+	data, ok := request.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := NewFakeMsg("agent.update."+testAgentID, requestID, data, numDelivered)
+	h.us.JetStreamUpdaterHandler(msg)
+	return msg
+}
+
+// iniStatus returns the status and the result of the last task saved in the INI file
+func (h *handlerTest) iniStatus(t *testing.T) (string, string) {
+	t.Helper()
+
+	cfg, err := ini.Load(h.ini)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Section("Agent").Key("UpdaterLastExecutionStatus").String(), cfg.Section("Agent").Key("UpdaterLastExecutionResult").String()
+}
+
+// waitForRequest waits until the request reaches a state in the ledger
+func (h *handlerTest) waitForRequest(t *testing.T, requestID, state string) {
+	t.Helper()
+
+	Eventually(t, 5*time.Second, func() bool {
+		r, ok := h.us.RequestLedger.Get(requestID)
+		return ok && r.State == state
+	}, "request %s didn't reach the %s state", requestID, state)
+}
+
+func TestUpdateHandlerInstallsAndVerifies(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "")
+	h.installs("1.2.0-1")
+
+	msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true}, 1)
+
+	if action := msg.WaitDone(t, 5*time.Second); action != "ack" {
+		t.Fatalf("the request has been answered with %q", action)
+	}
+	h.waitForRequest(t, "request-1", REQUEST_SUCCEEDED)
+
+	if status, result := h.iniStatus(t); status != openuem_nats.UPDATE_SUCCESS {
+		t.Errorf("the INI status is %s, %s", status, result)
+	}
+	if commands := h.deferred.Commands(); !slices.Equal(commands, []string{"apt install -y --allow-downgrades openuem-agent=1.2.0-1"}) {
+		t.Errorf("the deferred commands are %q", commands)
+	}
+	if !slices.Contains(h.runner.Commands(), "apt update") {
+		t.Errorf("the repositories haven't been refreshed, commands: %q", h.runner.Commands())
+	}
+}
+
+func TestUpdateHandlerRollsBack(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "")
+	// The new version doesn't stay running, the previous one is reinstalled
+	h.deferred.OnWait = func() {
+		if strings.Contains(strings.Join(h.deferred.Commands(), "\n"), "openuem-agent=1.0.0-1") {
+			h.runner.SetOutput(aptInstalledVersion, "1.0.0-1")
+			return
+		}
+		h.runner.SetOutput(aptInstalledVersion, "1.2.0-1")
+		_ = h.services.Stop(AgentServiceName)
+	}
+
+	msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true}, 1)
+
+	if action := msg.WaitDone(t, 5*time.Second); action != "ack" {
+		t.Fatalf("the request has been answered with %q", action)
+	}
+	h.waitForRequest(t, "request-1", REQUEST_FAILED)
+
+	status, result := h.iniStatus(t)
+	if status != openuem_nats.UPDATE_ERROR || !strings.HasPrefix(result, "[ROLLBACK]") {
+		t.Errorf("the INI status is %s, %s", status, result)
+	}
+	if !h.services.Running(AgentServiceName) {
+		t.Error("the agent should be running after the rollback")
+	}
+}
+
+func TestUpdateHandlerSkipsInstalledVersion(t *testing.T) {
+	h := newHandlerTest(t, "1.2.0-1", "")
+
+	msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0", UpdateNow: true}, 1)
+
+	if action := msg.WaitDone(t, 5*time.Second); action != "ack" {
+		t.Fatalf("the request has been answered with %q", action)
+	}
+	Eventually(t, 5*time.Second, func() bool {
+		status, _ := h.iniStatus(t)
+		return status == openuem_nats.UPDATE_SUCCESS
+	}, "the INI status should be success")
+
+	if commands := h.deferred.Commands(); len(commands) > 0 {
+		t.Errorf("nothing should be installed, deferred commands: %q", commands)
+	}
+}
+
+func TestUpdateHandlerRetriesFailedInstalls(t *testing.T) {
+	for _, tt := range []struct {
+		numDelivered uint64
+		action       string
+	}{
+		{1, "nak 5m0s"},
+		{3, "nak 20m0s"},
+		{5, "term "},
+	} {
+		h := newHandlerTest(t, "1.0.0-1", "")
+		h.deferred.Errors = map[string]error{"apt install -y --allow-downgrades openuem-agent=1.2.0-1": os.ErrPermission}
+
+		msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true}, tt.numDelivered)
+
+		if action := msg.WaitDone(t, 5*time.Second); !strings.HasPrefix(action, tt.action) {
+			t.Errorf("delivery %d has been answered with %q, expected %q", tt.numDelivered, action, tt.action)
+		}
+		h.waitForRequest(t, "request-1", REQUEST_FAILED)
+
+		if status, _ := h.iniStatus(t); status != openuem_nats.UPDATE_ERROR {
+			t.Errorf("delivery %d: the INI status is %s", tt.numDelivered, status)
+		}
+	}
+}
+
+func TestUpdateHandlerGivesUpPermanentErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		iniData string
+		request any
+	}{
+		{"malformed request", "", []byte("{")},
+		{"hostile version", "", openuem_nats.OpenUEMUpdateRequest{Version: "1.0;rm -rf /", UpdateNow: true}},
+		{"no maintenance window", "[Updater]\nBlackoutPeriods = 00:00-24:00\n", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true}},
+		{"invalid request blackout", "", []byte(`{"version": "1.2.0-1", "update_now": true, "blackout_periods": "8-18"}`)},
+	}
+
+	for _, tt := range tests {
+		h := newHandlerTest(t, "1.0.0-1", tt.iniData)
+
+		msg := h.update(t, "request-1", tt.request, 1)
+
+		if action := msg.WaitDone(t, 5*time.Second); !strings.HasPrefix(action, "term ") {
+			t.Errorf("%s: the request has been answered with %q", tt.name, action)
+		}
+		Eventually(t, 5*time.Second, func() bool {
+			status, _ := h.iniStatus(t)
+			return status == openuem_nats.UPDATE_ERROR
+		}, "%s: the INI status should be error", tt.name)
+		if commands := h.deferred.Commands(); len(commands) > 0 {
+			t.Errorf("%s: nothing should be installed, deferred commands: %q", tt.name, commands)
+		}
+	}
+}
+
+func TestUpdateHandlerSchedulesUpdates(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "")
+	updateAt := time.Now().Add(time.Hour)
+
+	msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateAt: updateAt}, 1)
+
+	if action := msg.WaitDone(t, time.Second); action != "ack" {
+		t.Fatalf("the request has been answered with %q", action)
+	}
+	h.waitForRequest(t, "request-1", REQUEST_SCHEDULED)
+
+	update, ok := h.us.UpdateQueue.Get("request-1")
+	if !ok || !update.Request.UpdateAt.Equal(updateAt) {
+		t.Errorf("the update should be queued for %s, got %+v", updateAt, update)
+	}
+	if commands := h.deferred.Commands(); len(commands) > 0 {
+		t.Errorf("nothing should be installed yet, deferred commands: %q", commands)
+	}
+}
+
+func TestUpdateHandlerWaitsForAnInvalidPolicy(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "[Updater]\nBlackoutPeriods = Mon-Fri 8-18\n")
+
+	msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true}, 1)
+
+	if action := msg.WaitDone(t, 5*time.Second); action != "nak 5m0s" {
+		t.Errorf("the request has been answered with %q", action)
+	}
+	if status, result := h.iniStatus(t); status != openuem_nats.UPDATE_ERROR || !strings.Contains(result, "BlackoutPeriods") {
+		t.Errorf("the INI status is %s, %s", status, result)
+	}
+	if commands := h.deferred.Commands(); len(commands) > 0 {
+		t.Errorf("nothing should be installed, deferred commands: %q", commands)
+	}
+}
+
+// blackoutFromNow returns a blackout period starting in the current minute
+func blackoutFromNow(minutes int) string {
+	now := time.Now().Local()
+	return fmt.Sprintf("[Updater]\nBlackoutPeriods = %s-%s\n", now.Format("15:04"), now.Add(time.Duration(minutes)*time.Minute).Format("15:04"))
+}
+
+func TestScheduledUpdateIsDeferredByBlackout(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", blackoutFromNow(2))
+
+	// Scheduled before the blackout was known, it's checked again when it's due
+	msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateAt: time.Now().Add(200 * time.Millisecond)}, 1)
+	if action := msg.WaitDone(t, time.Second); action != "ack" {
+		t.Fatalf("the request has been answered with %q", action)
+	}
+
+	Eventually(t, 5*time.Second, func() bool {
+		update, ok := h.us.UpdateQueue.Get("request-1")
+		return ok && update.Request.UpdateAt.After(time.Now().Add(time.Minute))
+	}, "the update should be deferred to the end of the blackout")
+
+	if commands := h.deferred.Commands(); len(commands) > 0 {
+		t.Errorf("nothing should be installed in a blackout, deferred commands: %q", commands)
+	}
+	if r, _ := h.us.RequestLedger.Get("request-1"); r.State != REQUEST_SCHEDULED {
+		t.Errorf("the request should still be scheduled, got %s", r.State)
+	}
+}
+
+func TestScheduledUpdateIsGivenUpWithoutWindow(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "[Updater]\nBlackoutPeriods = 00:00-24:00\n")
+
+	msg := h.update(t, "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateAt: time.Now().Add(200 * time.Millisecond)}, 1)
+	if action := msg.WaitDone(t, time.Second); action != "ack" {
+		t.Fatalf("the request has been answered with %q", action)
+	}
+
+	h.waitForRequest(t, "request-1", REQUEST_FAILED)
+	if _, ok := h.us.UpdateQueue.Get("request-1"); ok {
+		t.Error("the update should be removed from the queue")
+	}
+	if status, _ := h.iniStatus(t); status != openuem_nats.UPDATE_ERROR {
+		t.Errorf("the INI status is %s", status)
+	}
+	if commands := h.deferred.Commands(); len(commands) > 0 {
+		t.Errorf("nothing should be installed, deferred commands: %q", commands)
+	}
+}
+
+func TestUpdateHandlerAcksDuplicates(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "")
+	h.installs("1.2.0-1")
+
+	request := openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true}
+	h.update(t, "request-1", request, 1).WaitDone(t, 5*time.Second)
+	h.waitForRequest(t, "request-1", REQUEST_SUCCEEDED)
+
+	msg := h.update(t, "request-1", request, 2)
+
+	if action := msg.WaitDone(t, time.Second); action != "ack" {
+		t.Errorf("the duplicate has been answered with %q", action)
+	}
+	if commands := h.deferred.Commands(); len(commands) != 1 {
+		t.Errorf("the update should be installed once, deferred commands: %q", commands)
+	}
+}
+
+func TestUpdateHandlerAcksDuplicatesOfRunningUpdates(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "")
+
+	installing := make(chan struct{})
+	finish := make(chan struct{})
+	h.deferred.OnWait = func() {
+		close(installing)
+		<-finish
+		h.runner.SetOutput(aptInstalledVersion, "1.2.0-1")
+	}
+
+	request := openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true}
+	h.update(t, "request-1", request, 1)
+	<-installing
+
+	// The running update owns the first delivery, the duplicate is acked
+	msg := h.update(t, "request-1", request, 2)
+	if action := msg.WaitDone(t, time.Second); action != "ack" {
+		t.Errorf("the duplicate has been answered with %q", action)
+	}
+
+	close(finish)
+	h.waitForRequest(t, "request-1", REQUEST_SUCCEEDED)
+}
+
+func TestUninstallHandler(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "")
+
+	msg := NewFakeMsg("agent.uninstall."+testAgentID, "request-1", nil, 1)
+	h.us.JetStreamUpdaterHandler(msg)
+
+	if action := msg.WaitDone(t, time.Second); action != "ack" {
+		t.Errorf("the request has been answered with %q", action)
+	}
+	if commands := h.deferred.Commands(); !slices.Equal(commands, []string{"apt purge -y openuem-agent"}) {
+		t.Errorf("the deferred commands are %q", commands)
+	}
+}
+
+func TestRestartHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		errors  map[string]error
+		actions []string
+	}{
+		{"restarted", nil, []string{"stop " + AgentServiceName, "start " + AgentServiceName}},
+		{"stop fails", map[string]error{"stop " + AgentServiceName: errors.New("timeout")}, []string{"stop " + AgentServiceName}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandlerTest(t, "1.0.0-1", "")
+			h.services.Errors = tt.errors
+
+			h.us.restartHandler(&nats.Msg{Subject: "agent.restart." + testAgentID})
+
+			if actions := h.services.Actions(); !slices.Equal(actions, tt.actions) {
+				t.Errorf("the service actions are %q", actions)
+			}
+		})
+	}
+}
+
+func TestCancelAndRescheduleUpdate(t *testing.T) {
+	h := newHandlerTest(t, "1.0.0-1", "")
+
+	for _, id := range []string{"request-1", "request-2"} {
+		msg := h.update(t, id, openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateAt: time.Now().Add(time.Hour)}, 1)
+		if action := msg.WaitDone(t, time.Second); action != "ack" {
+			t.Fatalf("the request has been answered with %q", action)
+		}
+	}
+
+	if err := h.us.CancelUpdate("request-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.us.UpdateQueue.Get("request-1"); ok {
+		t.Error("the cancelled update is still queued")
+	}
+	if err := h.us.CancelUpdate("request-1"); err == nil {
+		t.Error("an update can only be cancelled once")
+	}
+
+	updateAt := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	if err := h.us.RescheduleUpdate("request-2", updateAt); err != nil {
+		t.Fatal(err)
+	}
+	if update, ok := h.us.UpdateQueue.Get("request-2"); !ok || !update.Request.UpdateAt.Equal(updateAt) {
+		t.Errorf("the update should be queued for %s, got %+v", updateAt, update)
+	}
+	if nextRun, err := h.us.PendingJobs["request-2"].NextRun(); err != nil || !nextRun.Equal(updateAt) {
+		t.Errorf("the update job should run at %s, got %s, %v", updateAt, nextRun, err)
+	}
+	if jobs := h.us.TaskScheduler.Jobs(); len(jobs) != 1 {
+		t.Errorf("only the rescheduled job should be left, got %d jobs", len(jobs))
+	}
+
+	if err := h.us.RescheduleUpdate("request-2", time.Time{}); err == nil {
+		t.Error("an update can't be rescheduled without a time")
+	}
+	if err := h.us.RescheduleUpdate("request-1", updateAt); err == nil {
+		t.Error("a cancelled update can't be rescheduled")
+	}
+}
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/ini.v1"
+)
+
+// HealthProbe checks one aspect of an agent whose service is running
+type HealthProbe interface {
+	Name() string
+	Check(now time.Time) error
+}
+
+// HealthConfig holds the thresholds of the health probes, a zero value disables a probe.
+// They're read from the Updater section of the agent's INI file
+type HealthConfig struct {
+	HeartbeatMaxAge time.Duration
+	LogMaxAge       time.Duration
+	NATSPing        bool
+	NATSPingTimeout time.Duration
+	UnhealthyChecks int
+}
+
+// ReadHealthConfig reads the health probe thresholds, e.g:
+//
+//	[Updater]
+//	HeartbeatMaxAgeMinutes = 15
+//	LogMaxAgeMinutes = 60
+//	HealthNATSPing = true
+//	HealthNATSPingTimeoutSeconds = 10
+//	UnhealthyChecks = 2
+func ReadHealthConfig() *HealthConfig {
+	c := HealthConfig{
+		HeartbeatMaxAge: 15 * time.Minute,
+		NATSPingTimeout: 10 * time.Second,
+		UnhealthyChecks: 2,
+	}
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return &c
+	}
+
+	section := cfg.Section("Updater")
+	c.HeartbeatMaxAge = time.Duration(section.Key("HeartbeatMaxAgeMinutes").MustInt(int(c.HeartbeatMaxAge.Minutes()))) * time.Minute
+	c.LogMaxAge = time.Duration(section.Key("LogMaxAgeMinutes").MustInt(0)) * time.Minute
+	c.NATSPing = section.Key("HealthNATSPing").MustBool(false)
+	c.NATSPingTimeout = time.Duration(section.Key("HealthNATSPingTimeoutSeconds").MustInt(int(c.NATSPingTimeout.Seconds()))) * time.Second
+	c.UnhealthyChecks = section.Key("UnhealthyChecks").MustInt(c.UnhealthyChecks)
+
+	return &c
+}
+
+// HeartbeatProbe checks the Heartbeat timestamp the agent writes to the INI file.
+// Agents that don't write a heartbeat yet are considered healthy
+type HeartbeatProbe struct {
+	MaxAge time.Duration
+}
+
+func (p HeartbeatProbe) Name() string {
+	return "heartbeat"
+}
+
+func (p HeartbeatProbe) Check(now time.Time) error {
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return nil
+	}
+
+	value := cfg.Section("Agent").Key("Heartbeat").String()
+	if value == "" {
+		return nil
+	}
+
+	heartbeat, err := time.ParseInLocation("2006-01-02T15:04:05", value, time.Local)
+	if err != nil {
+		return fmt.Errorf("could not parse heartbeat %q", value)
+	}
+
+	if age := now.Sub(heartbeat); age > p.MaxAge {
+		return fmt.Errorf("last heartbeat was %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// LogAgeProbe checks that the agent keeps writing its log
+type LogAgeProbe struct {
+	Path   string
+	MaxAge time.Duration
+}
+
+func (p LogAgeProbe) Name() string {
+	return "log"
+}
+
+func (p LogAgeProbe) Check(now time.Time) error {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return fmt.Errorf("could not stat agent log, reason: %v", err)
+	}
+
+	if age := now.Sub(info.ModTime()); age > p.MaxAge {
+		return fmt.Errorf("agent log was last written %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// NATSPingProbe sends a request to the agent and waits for its reply
+type NATSPingProbe struct {
+	Conn    *nats.Conn
+	Subject string
+	Timeout time.Duration
+}
+
+func (p NATSPingProbe) Name() string {
+	return "nats"
+}
+
+func (p NATSPingProbe) Check(now time.Time) error {
+	// We can't blame the agent if we're not connected
+	if p.Conn == nil || !p.Conn.IsConnected() {
+		return nil
+	}
+
+	if _, err := p.Conn.Request(p.Subject, nil, p.Timeout); err != nil {
+		return fmt.Errorf("agent didn't answer on %s, reason: %v", p.Subject, err)
+	}
+	return nil
+}
+
+// HealthProbes returns the enabled probes
+func (us *UpdaterService) HealthProbes() []HealthProbe {
+	probes := []HealthProbe{}
+
+	if us.HealthConfig.HeartbeatMaxAge > 0 {
+		probes = append(probes, HeartbeatProbe{MaxAge: us.HealthConfig.HeartbeatMaxAge})
+	}
+
+	if us.HealthConfig.LogMaxAge > 0 {
+		probes = append(probes, LogAgeProbe{Path: AgentLogFile, MaxAge: us.HealthConfig.LogMaxAge})
+	}
+
+	if us.HealthConfig.NATSPing {
+		probes = append(probes, NATSPingProbe{Conn: us.connection(), Subject: "agent.ping." + us.AgentId, Timeout: us.HealthConfig.NATSPingTimeout})
+	}
+
+	return probes
+}
+
+// CheckAgentHealth runs the probes against an agent whose service is running
+// and restarts it after UnhealthyChecks consecutive failed checks
+func (us *UpdaterService) CheckAgentHealth() {
+	now := time.Now()
+
+	errs := []error{}
+	for _, probe := range us.HealthProbes() {
+		if err := probe.Check(now); err != nil {
+			errs = append(errs, fmt.Errorf("%s probe: %v", probe.Name(), err))
+		}
+	}
+
+	if len(errs) == 0 {
+		us.unhealthyResults = 0
+		return
+	}
+
+	us.unhealthyResults++
+	slog.Error("the agent is running but unhealthy", "checks", us.unhealthyResults, "max_checks", us.HealthConfig.UnhealthyChecks, "error", errors.Join(errs...))
+
+	if us.unhealthyResults < us.HealthConfig.UnhealthyChecks {
+		return
+	}
+
+	us.unhealthyResults = 0
+	if err := us.RestartService(); err != nil {
+		slog.Error("could not restart the unhealthy agent", "error", err)
+		return
+	}
+	slog.Info("the agent has been restarted as it was unhealthy")
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// withAgentConfig writes the agent's INI file to a temporary directory and
+// points AgentConfigFile to it
+func withAgentConfig(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "openuem.ini")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configFile := AgentConfigFile
+	AgentConfigFile = func() string { return path }
+	t.Cleanup(func() { AgentConfigFile = configFile })
+
+	return path
+}
+
+// withAgentLog writes the agent's log to a temporary directory and points
+// AgentLogFile to it
+func withAgentLog(t *testing.T, modTime time.Time) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "openuem-agent.log")
+	if err := os.WriteFile(path, []byte("log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	logFile := AgentLogFile
+	AgentLogFile = path
+	t.Cleanup(func() { AgentLogFile = logFile })
+
+	return path
+}
+
+// heartbeat returns the Heartbeat key the agent writes in its INI section
+func heartbeat(at time.Time) string {
+	return "Heartbeat = " + at.Local().Format("2006-01-02T15:04:05") + "\n"
+}
+
+func TestHeartbeatProbe(t *testing.T) {
+	now := time.Now()
+	probe := HeartbeatProbe{MaxAge: 15 * time.Minute}
+
+	tests := []struct {
+		name    string
+		ini     string
+		healthy bool
+	}{
+		{"fresh", "[Agent]\n" + heartbeat(now.Add(-time.Minute)), true},
+		{"stale", "[Agent]\n" + heartbeat(now.Add(-time.Hour)), false},
+		{"missing", "[Agent]\nUUID = " + testAgentID + "\n", true},
+		{"invalid", "[Agent]\nHeartbeat = yesterday\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAgentConfig(t, tt.ini)
+
+			if err := probe.Check(now); (err == nil) != tt.healthy {
+				t.Errorf("expected healthy %t, got %v", tt.healthy, err)
+			}
+		})
+	}
+}
+
+func TestLogAgeProbe(t *testing.T) {
+	now := time.Now()
+	path := withAgentLog(t, now.Add(-2*time.Hour))
+
+	if err := (LogAgeProbe{Path: path, MaxAge: 3 * time.Hour}).Check(now); err != nil {
+		t.Errorf("a log written inside MaxAge is healthy, got %v", err)
+	}
+	if err := (LogAgeProbe{Path: path, MaxAge: time.Hour}).Check(now); err == nil {
+		t.Error("a log older than MaxAge is unhealthy")
+	}
+	if err := (LogAgeProbe{Path: path + ".missing", MaxAge: time.Hour}).Check(now); err == nil {
+		t.Error("a missing log is unhealthy")
+	}
+}
+
+func TestReadHealthConfig(t *testing.T) {
+	withAgentConfig(t, "[Updater]\nHeartbeatMaxAgeMinutes = 0\nLogMaxAgeMinutes = 60\nHealthNATSPing = true\nUnhealthyChecks = 3\n")
+
+	c := ReadHealthConfig()
+	if c.HeartbeatMaxAge != 0 || c.LogMaxAge != time.Hour || !c.NATSPing || c.NATSPingTimeout != 10*time.Second || c.UnhealthyChecks != 3 {
+		t.Errorf("unexpected health config %+v", c)
+	}
+
+	us := UpdaterService{HealthConfig: c}
+	names := []string{}
+	for _, p := range us.HealthProbes() {
+		names = append(names, p.Name())
+	}
+	if !slices.Equal(names, []string{"log", "nats"}) {
+		t.Errorf("the enabled probes are %q", names)
+	}
+}
+
+func TestCheckAgentHealthRestartsUnhealthyAgent(t *testing.T) {
+	withAgentConfig(t, "[Agent]\n"+heartbeat(time.Now().Add(-time.Hour)))
+	services := NewFakeServiceController(AgentServiceName)
+	us := UpdaterService{Services: services, HealthConfig: &HealthConfig{HeartbeatMaxAge: 15 * time.Minute, UnhealthyChecks: 2}}
+
+	us.CheckAgentHealth()
+	if actions := services.Actions(); len(actions) > 0 {
+		t.Fatalf("the agent shouldn't be restarted after one failed check, got %q", actions)
+	}
+
+	us.CheckAgentHealth()
+	if actions := services.Actions(); !slices.Equal(actions, []string{"stop " + AgentServiceName, "start " + AgentServiceName}) {
+		t.Errorf("the service actions are %q", actions)
+	}
+	if us.unhealthyResults != 0 {
+		t.Errorf("the failed checks should be reset after a restart, got %d", us.unhealthyResults)
+	}
+}
+
+func TestCheckAgentHealthResetsFailedChecks(t *testing.T) {
+	path := withAgentConfig(t, "[Agent]\n"+heartbeat(time.Now().Add(-time.Hour)))
+	services := NewFakeServiceController(AgentServiceName)
+	us := UpdaterService{Services: services, HealthConfig: &HealthConfig{HeartbeatMaxAge: 15 * time.Minute, UnhealthyChecks: 2}}
+
+	us.CheckAgentHealth()
+
+	if err := os.WriteFile(path, []byte("[Agent]\n"+heartbeat(time.Now())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us.CheckAgentHealth()
+
+	if err := os.WriteFile(path, []byte("[Agent]\n"+heartbeat(time.Now().Add(-time.Hour))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us.CheckAgentHealth()
+
+	if actions := services.Actions(); len(actions) > 0 {
+		t.Errorf("the failed checks weren't consecutive, got %q", actions)
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	openuem_utils "github.com/open-uem/utils"
+	"gopkg.in/ini.v1"
+)
+
+// AgentConfigFile returns the path of the agent's INI file shared with the updater
+var AgentConfigFile = openuem_utils.GetAgentConfigFile
+
+// INILockTimeout is how long we try to get the lock of the INI file, and
+// to replace it, while the agent is writing it too
+var INILockTimeout = 10 * time.Second
+
+// errFileLocked is returned by lockFile when another process holds the lock
+var errFileLocked = errors.New("the file is locked by another process")
+
+// iniMu serializes the writers of the updater so they don't spin on each other's lock
+var iniMu sync.Mutex
+
+// UpdateINI loads the INI file holding its lock, calls update to modify it
+// and, if update reports changes, replaces the file atomically so the agent
+// never reads a truncated file and none of its keys are lost
+func UpdateINI(path string, update func(cfg *ini.File) bool) error {
+	iniMu.Lock()
+	defer iniMu.Unlock()
+
+	deadline := time.Now().Add(INILockTimeout)
+
+	unlock, err := lockINI(path, deadline)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Load the file after getting the lock so we modify its latest contents
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return fmt.Errorf("could not load config file, reason: %v", err)
+	}
+
+	if !update(cfg) {
+		return nil
+	}
+
+	var data bytes.Buffer
+	if _, err := cfg.WriteTo(&data); err != nil {
+		return fmt.Errorf("could not encode config file, reason: %v", err)
+	}
+
+	perm := fs.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	// The agent may have the file open for a moment, e.g on Windows
+	for {
+		err = writeFileAtomic(path, data.Bytes(), perm)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// resetRestartRequired clears the flag the agent sets to ask for a restart
+func resetRestartRequired() error {
+	return UpdateINI(AgentConfigFile(), func(cfg *ini.File) bool {
+		cfg.Section("Agent").Key("RestartRequired").SetValue("false")
+		return true
+	})
+}
+
+// lockINI takes the lock of the INI file retrying until the deadline. The
+// lock is taken on a separate file as the INI file is replaced when saved
+func lockINI(path string, deadline time.Time) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config lock file, reason: %v", err)
+	}
+
+	wait := 50 * time.Millisecond
+	for {
+		err = lockFile(f)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errFileLocked) || time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("could not lock config file, reason: %v", err)
+		}
+		time.Sleep(wait)
+		wait = min(2*wait, time.Second)
+	}
+
+	return func() {
+		_ = unlockFile(f)
+		f.Close()
+	}, nil
+}
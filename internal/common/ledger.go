@@ -0,0 +1,257 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	openuem_nats "github.com/open-uem/nats"
+)
+
+// States of the requests kept in the request ledger
+const (
+	REQUEST_SCHEDULED = "scheduled"
+	REQUEST_RUNNING   = "running"
+	REQUEST_SUCCEEDED = "succeeded"
+	REQUEST_FAILED    = "failed"
+	REQUEST_CANCELLED = "cancelled"
+)
+
+// UPDATE_PHASE_DUPLICATE is reported when a request that has already been
+// handled is received again
+const UPDATE_PHASE_DUPLICATE = "duplicate"
+
+// RequestLedgerRetention is how long the requests are remembered
+var RequestLedgerRetention = 30 * 24 * time.Hour
+
+// RequestRecord is the last known state of an update request
+type RequestRecord struct {
+	RequestID string    `json:"request_id"`
+	Version   string    `json:"version,omitempty"`
+	State     string    `json:"state"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RequestLedger keeps the state of the update requests in a JSON state file
+// so a redelivered request is not applied twice
+type RequestLedger struct {
+	path    string
+	mu      sync.Mutex
+	records map[string]RequestRecord
+}
+
+// LoadRequestLedger reads the ledger from path, an empty ledger is returned if
+// the file doesn't exist yet
+func LoadRequestLedger(path string) (*RequestLedger, error) {
+	l := RequestLedger{path: path, records: map[string]RequestRecord{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &l, nil
+		}
+		return &l, fmt.Errorf("could not read request ledger, reason: %v", err)
+	}
+
+	records := []RequestRecord{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return &l, fmt.Errorf("could not parse request ledger, reason: %v", err)
+	}
+
+	for _, r := range records {
+		l.records[r.RequestID] = r
+	}
+
+	return &l, nil
+}
+
+// Get returns the record of a request
+func (l *RequestLedger) Get(requestID string) (RequestRecord, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r, ok := l.records[requestID]
+	return r, ok
+}
+
+// Set stores the state of a request and forgets the requests older than
+// RequestLedgerRetention. The version is kept if it's not set
+func (l *RequestLedger) Set(requestID, version, state string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	r := l.records[requestID]
+	r.RequestID = requestID
+	if version != "" {
+		r.Version = version
+	}
+	r.State = state
+	r.UpdatedAt = now
+	l.records[requestID] = r
+
+	for id, r := range l.records {
+		if now.Sub(r.UpdatedAt) > RequestLedgerRetention {
+			delete(l.records, id)
+		}
+	}
+
+	records := []RequestRecord{}
+	for _, r := range l.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].UpdatedAt.Before(records[j].UpdatedAt)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteStateFile(l.path, data)
+}
+
+// LoadRequestLedger reads the requests handled before the updater was restarted
+func (us *UpdaterService) LoadRequestLedger() {
+	path, err := StateFile("requests.json")
+	if err != nil {
+		slog.Error("the request ledger can't be stored", "error", err)
+	}
+
+	us.RequestLedger, err = LoadRequestLedger(path)
+	if err != nil {
+		slog.Error("could not load the request ledger", "error", err)
+	}
+}
+
+// requestState returns the ledger state matching an update phase, empty
+// if the phase doesn't change it
+func requestState(phase string) string {
+	switch phase {
+	case UPDATE_PHASE_SCHEDULED:
+		return REQUEST_SCHEDULED
+	case UPDATE_PHASE_DOWNLOADING, UPDATE_PHASE_INSTALLING, UPDATE_PHASE_RESTARTING, UPDATE_PHASE_VERIFYING:
+		return REQUEST_RUNNING
+	case UPDATE_PHASE_SUCCEEDED:
+		return REQUEST_SUCCEEDED
+	case UPDATE_PHASE_FAILED, UPDATE_PHASE_ROLLED_BACK:
+		return REQUEST_FAILED
+	case UPDATE_PHASE_CANCELLED:
+		return REQUEST_CANCELLED
+	}
+	return ""
+}
+
+// recordRequest updates the state of a request in the ledger
+func (us *UpdaterService) recordRequest(requestID, version, state string) {
+	if us.RequestLedger == nil || state == "" {
+		return
+	}
+
+	if err := us.RequestLedger.Set(requestID, version, state); err != nil {
+		slog.Error("could not save the request ledger", "request_id", requestID, "error", err)
+	}
+}
+
+// updateRunning reports if an update is running in this process
+func (us *UpdaterService) updateRunning(requestID string) bool {
+	us.runningMu.Lock()
+	defer us.runningMu.Unlock()
+
+	_, ok := us.runningUpdates[requestID]
+	return ok
+}
+
+// duplicateUpdate handles a request that has already been received. It
+// reports true if the message has been handled and must not be processed
+// again. Failed and cancelled requests can be retried
+func (us *UpdaterService) duplicateUpdate(requestID string, msg jetstream.Msg) bool {
+	logger := slog.With("request_id", requestID)
+
+	if us.RequestLedger == nil {
+		return false
+	}
+
+	r, ok := us.RequestLedger.Get(requestID)
+	if !ok {
+		return false
+	}
+
+	switch r.State {
+	case REQUEST_SUCCEEDED:
+		logger.Info("the update has already been applied, ignoring the request", "version", r.Version)
+	case REQUEST_SCHEDULED:
+		if _, ok := us.UpdateQueue.Get(requestID); !ok {
+			return false
+		}
+		logger.Info("the update is already scheduled, ignoring the request")
+	case REQUEST_RUNNING:
+		if !us.updateRunning(requestID) {
+			// The updater was restarted during the update, apply it only if needed
+			return false
+		}
+
+		// The running update owns the original delivery and acks it when it's done
+		logger.Info("the update is already running, ignoring the request")
+	default:
+		return false
+	}
+
+	AckMessage(msg)
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_DUPLICATE, nil, nil, "")
+	return true
+}
+
+// agentAtVersion reports if the requested version of the agent is already
+// installed, in which case there's nothing to update
+func (us *UpdaterService) agentAtVersion(version string) (string, bool) {
+	if version == "" {
+		return "", false
+	}
+
+	installed, err := us.InstalledAgentVersion()
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			slog.Warn("could not get the installed agent version", "error", err)
+		}
+		return "", false
+	}
+
+	return installed, VersionMatches(installed, version)
+}
+
+// executeUpdate runs an update unless the agent already has the requested version
+func (us *UpdaterService) executeUpdate(requestID string, data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) {
+	if installed, ok := us.agentAtVersion(data.Version); ok {
+		slog.Info("the agent is already at the requested version, skipping the update", "request_id", requestID, "version", installed)
+		AckMessage(msg)
+		SaveTaskInfoToINI(openuem_nats.UPDATE_SUCCESS, fmt.Sprintf("the agent is already at version %s", installed))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_SUCCEEDED, nil, nil, installed)
+		return
+	}
+
+	us.recordRequest(requestID, data.Version, REQUEST_RUNNING)
+	us.ExecuteUpdate(requestID, data, msg)
+}
+
+// VersionMatches reports if an installed package version corresponds to the
+// requested version, ignoring the distribution revision (1.0.0-1 matches 1.0.0)
+// and the epoch if the request doesn't have one (1:1.0.0-1 matches 1.0.0-1)
+func VersionMatches(installed, requested string) bool {
+	if requested == "" {
+		return installed != ""
+	}
+	if !strings.Contains(requested, ":") {
+		if _, version, found := strings.Cut(installed, ":"); found {
+			installed = version
+		}
+	}
+	return installed == requested || strings.HasPrefix(installed, requested+"-")
+}
@@ -4,23 +4,24 @@ package common
 
 import (
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"time"
+	"log/slog"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go/jetstream"
 	openuem_nats "github.com/open-uem/nats"
-	openuem_utils "github.com/open-uem/utils"
-	"github.com/zcalusic/sysinfo"
 )
 
 func NewUpdateService() (*UpdaterService, error) {
 	var err error
-	us := UpdaterService{}
+	us := UpdaterService{
+		Runner:       ExecCommandRunner{},
+		Services:     SystemdServiceController{Runner: ExecCommandRunner{}},
+		OSRelease:    SystemOSRelease,
+		OSTreeBooted: IsOSTreeBooted,
+	}
+	us.DeferredRunners = func(unit string) DeferredRunner {
+		return NewDeferredRunner(us.Runner, unit)
+	}
 	us.Logger = NewLogger("openuem-updater.log")
 
 	us.TaskScheduler, err = gocron.NewScheduler()
@@ -31,142 +32,126 @@ func NewUpdateService() (*UpdaterService, error) {
 	return &us, nil
 }
 
-func ExecuteUpdate(data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) {
-	var cmd *exec.Cmd
-
-	os := GetOSVendor()
+func (us *UpdaterService) ExecuteUpdate(requestID string, data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) {
+	logger := slog.With("request_id", requestID)
 
-	// Refresh repositories before install
-	RefreshRepositories(os)
-
-	// Start install command
-	version := data.Version
-
-	// Update package
-	switch os {
-	case "debian", "ubuntu", "linuxmint", "neon":
-		cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("echo \"%s\" | at now +1 minute", "sudo apt install -y --allow-downgrades openuem-agent="+version))
-	case "fedora", "opensuse-leap", "almalinux", "redhat", "rocky":
-		description := GetOSDescription()
-		if strings.Contains(description, "Silverblue") || strings.Contains(description, "Kinoite") {
-			cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("sudo touch /var/spool/at/.SEQ && echo \"%s\" | at now +1 minute", "sudo rpm-ostree install openuem-agent"))
-		} else {
-			cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("echo \"%s\" | at now +1 minute", "sudo dnf install --allow-downgrade --refresh -y openuem-agent-"+version))
-		}
+	deferred := us.DeferredRunners("openuem-agent-update-" + requestID)
+	pm, err := us.packageManager(deferred)
+	if err != nil {
+		logger.Error("could not update the agent", "error", err)
+		us.RetryMessage(msg, requestID, Permanent(err))
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ERROR]: %v", err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
+		return
 	}
 
-	if cmd == nil {
-		if err := msg.Ack(); err != nil {
-			log.Printf("[ERROR]: could not ACK message, reason: %v", err)
-		}
-		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ERROR]: unsupported OS: %s", os))
+	// The version comes from the message bus, reject anything the package manager wouldn't accept
+	if err := pm.ValidateVersion(data.Version); err != nil {
+		logger.Error("could not update the agent", "error", err)
+		us.RetryMessage(msg, requestID, Permanent(err))
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ERROR]: %v", err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
 		return
 	}
 
-	err := cmd.Start()
+	// Record the installed version so we can roll back if the update fails
+	previousVersion, err := pm.InstalledVersion(AgentPackage)
 	if err != nil {
-		log.Printf("[ERROR]: could not run %s command, reason: %v", cmd.String(), err)
-		msg.NakWithDelay(60 * time.Minute)
-		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ERROR]: could not run %s command, reason: %v", cmd.String(), err))
-		return
+		logger.Warn("could not get the installed agent version, rollback won't be possible", "error", err)
 	}
 
-	// Confirm that update is going to run
-	SaveTaskInfoToINI(openuem_nats.UPDATE_SUCCESS, "")
+	source, extraKeys := ReadPackageSource()
+
+	var installErr error
+	if source == PACKAGE_SOURCE_DOWNLOAD {
+		// Install the signed package sent by the server
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_DOWNLOADING, nil, nil, previousVersion)
+		packagePath, err := DownloadAgentPackage(data, pm.PackageExtension(), extraKeys)
+		if err != nil {
+			logger.Error("could not download the agent package", "error", err)
+			us.RetryMessage(msg, requestID, err)
+			SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ERROR]: %v", err))
+			us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, previousVersion)
+			return
+		}
 
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not ACK message, reason: %v", err)
-	}
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_INSTALLING, nil, nil, previousVersion)
+		installErr = pm.InstallFile(packagePath)
+	} else {
+		// Refresh repositories before install
+		if err := pm.Refresh(); err != nil {
+			logger.Error("could not refresh repositories", "error", err)
+		}
 
-	log.Println("[INFO]: update command has been programmed: ", cmd.String())
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_INSTALLING, nil, nil, previousVersion)
+		installErr = pm.Install(AgentPackage, data.Version)
+	}
 
-	if err := cmd.Wait(); err != nil {
-		log.Printf("[ERROR]: Command finished with error: %v", err)
+	if installErr != nil {
+		logger.Error("could not run install command", "package_manager", pm.Name(), "error", installErr)
+		us.RetryMessage(msg, requestID, installErr)
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ERROR]: could not run %s install command, reason: %v", pm.Name(), installErr))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, installErr, previousVersion)
 		return
 	}
 
-}
-
-func NewLogger(logFilename string) *openuem_utils.OpenUEMLogger {
-	var err error
+	// The update is going to run, success is confirmed once verified
+	SaveTaskInfoToINI(openuem_nats.UPDATE_PENDING, "")
 
-	logger := openuem_utils.OpenUEMLogger{}
+	AckMessage(msg)
 
-	// Get executable path to store logs
-	wd := "/var/log/openuem-agent"
+	logger.Info("update command has been programmed", "package_manager", pm.Name())
 
-	if _, err := os.Stat(wd); os.IsNotExist(err) {
-		if err := os.MkdirAll(wd, 0660); err != nil {
-			log.Fatalf("[FATAL]: could not create log directory, reason: %v", err)
-		}
+	// Wait for the package manager so we report its real outcome
+	result, err := deferred.Wait(InstallWindow)
+	if err == nil {
+		err = result.Err()
 	}
-
-	logPath := filepath.Join(wd, logFilename)
-	logger.LogFile, err = os.Create(logPath)
 	if err != nil {
-		log.Fatalf("could not create log file,: %v", err)
+		logger.Error("install command failed", "package_manager", pm.Name(), "error", err)
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ERROR]: %s install command failed, reason: %v", pm.Name(), err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, previousVersion)
+		return
 	}
 
-	logPrefix := strings.TrimSuffix(filepath.Base(logFilename), filepath.Ext(logFilename))
-	log.SetOutput(logger.LogFile)
-	log.SetPrefix(logPrefix + ": ")
-	log.SetFlags(log.Ldate | log.Ltime)
-
-	return &logger
+	us.VerifyUpdate(requestID, pm, deferred, data.Version, previousVersion)
 }
 
-func UninstallAgent() error {
-	var cmd *exec.Cmd
+func LogDir() (string, error) {
+	return "/var/log/openuem-agent", nil
+}
 
-	os := GetOSVendor()
+// GetStateDir returns the directory where the updater keeps its state files
+func GetStateDir() (string, error) {
+	return "/var/lib/openuem-agent/updater", nil
+}
 
-	switch os {
-	case "debian", "ubuntu", "linuxmint":
-		cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("echo \"%s\" | at now +1 minute", "sudo apt purge -y openuem-agent"))
-	case "fedora", "almalinux", "redhat", "rocky":
-		description := GetOSDescription()
-		if strings.Contains(description, "Silverblue") || strings.Contains(description, "Kinoite") {
-			cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("sudo touch /var/spool/at/.SEQ && echo \"%s\" | at now +1 minute", "sudo rpm-ostree uninstall openuem-agent"))
-		} else {
-			cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("echo \"%s\" | at now +1 minute", "sudo dnf remove -y openuem-agent"))
-		}
+// packageManager returns the package manager of the distribution using the
+// given runner for the deferred commands
+func (us *UpdaterService) packageManager(deferred CommandRunner) (PackageManager, error) {
+	return NewPackageManager(us.OSRelease, us.OSTreeBooted, us.Runner, deferred)
+}
 
-	default:
-		return fmt.Errorf("unsupported os")
+// InstalledAgentVersion asks the package manager for the agent version
+func (us *UpdaterService) InstalledAgentVersion() (string, error) {
+	pm, err := us.packageManager(us.Runner)
+	if err != nil {
+		return "", err
 	}
+	return pm.InstalledVersion(AgentPackage)
+}
 
-	// Start apt remove command
-	err := cmd.Start()
+func (us *UpdaterService) UninstallAgent() error {
+	pm, err := us.packageManager(us.DeferredRunners("openuem-agent-uninstall"))
 	if err != nil {
 		return err
 	}
 
-	log.Println("[INFO]: uninstall command has been programmed: ", cmd.String())
-
-	return nil
-}
-
-func GetOSVendor() string {
-	var si sysinfo.SysInfo
-
-	si.GetSysInfo()
-
-	return si.OS.Vendor
-}
-
-func GetOSDescription() string {
-	var si sysinfo.SysInfo
-
-	si.GetSysInfo()
+	if err := pm.Remove(AgentPackage); err != nil {
+		return err
+	}
 
-	return si.OS.Name
-}
+	slog.Info("uninstall command has been programmed", "package_manager", pm.Name())
 
-func RefreshRepositories(os string) {
-	switch os {
-	case "debian", "ubuntu", "linuxmint":
-		if err := exec.Command("apt", "update").Run(); err != nil {
-			log.Printf("[ERROR]: could not run apt update, reason: %v", err)
-		}
-	}
+	return nil
 }
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	openuem_utils "github.com/open-uem/utils"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// LogConfig sets the level and the format of the updater log, it's read from
+// the Updater section of the agent's INI file, e.g:
+//
+//	[Updater]
+//	LogLevel = debug
+//	LogFormat = json
+type LogConfig struct {
+	Level  slog.Level
+	Format string
+}
+
+// ReadLogConfig returns the log settings, using info and text for the missing
+// or invalid keys
+func ReadLogConfig() (LogConfig, error) {
+	c := LogConfig{Level: slog.LevelInfo, Format: LOG_FORMAT_TEXT}
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return c, nil
+	}
+	section := cfg.Section("Updater")
+
+	if value := section.Key("LogLevel").String(); value != "" {
+		if err := c.Level.UnmarshalText([]byte(value)); err != nil {
+			return c, fmt.Errorf("%q is not a valid log level", value)
+		}
+	}
+
+	switch format := strings.ToLower(section.Key("LogFormat").MustString(LOG_FORMAT_TEXT)); format {
+	case LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+		c.Format = format
+	default:
+		return c, fmt.Errorf("%q is not a valid log format", format)
+	}
+
+	return c, nil
+}
+
+// NewLogHandler creates the slog handler for the configured format
+func NewLogHandler(w io.Writer, c LogConfig) slog.Handler {
+	options := slog.HandlerOptions{Level: c.Level}
+	if c.Format == LOG_FORMAT_JSON {
+		return slog.NewJSONHandler(w, &options)
+	}
+	return slog.NewTextHandler(w, &options)
+}
+
+// NewLogger opens the updater log, appending to the previous run's log as the
+// log rotation job takes care of its size, and makes it the output of the
+// default slog logger
+func NewLogger(logFilename string) *openuem_utils.OpenUEMLogger {
+	var err error
+
+	logger := openuem_utils.OpenUEMLogger{}
+
+	wd, err := LogDir()
+	if err != nil {
+		log.Fatalf("[FATAL]: could not get log directory, reason: %v", err)
+	}
+
+	if _, err := os.Stat(wd); os.IsNotExist(err) {
+		if err := os.MkdirAll(wd, 0660); err != nil {
+			log.Fatalf("[FATAL]: could not create log directory, reason: %v", err)
+		}
+	}
+
+	logPath := filepath.Join(wd, logFilename)
+	logger.LogFile, err = os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		log.Fatalf("[FATAL]: could not create log file, reason: %v", err)
+	}
+
+	config, configErr := ReadLogConfig()
+
+	// The log package is redirected to the default slog logger too
+	service := strings.TrimSuffix(filepath.Base(logFilename), filepath.Ext(logFilename))
+	slog.SetDefault(slog.New(NewLogHandler(logger.LogFile, config)).With("service", service))
+
+	if configErr != nil {
+		slog.Error("could not read log settings, using defaults", "error", configErr)
+	}
+
+	return &logger
+}
@@ -0,0 +1,277 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"gopkg.in/ini.v1"
+)
+
+// LogRotator rotates log files when they grow over MaxSize or haven't been
+// rotated for MaxAge, keeping at most Generations old files which are
+// compressed if Compress is set
+type LogRotator struct {
+	MaxSize     int64
+	MaxAge      time.Duration
+	Generations int
+	Compress    bool
+
+	mu sync.Mutex
+}
+
+// NewLogRotator reads the rotation policy from the Updater section of the
+// agent's INI file, e.g:
+//
+//	[Updater]
+//	LogMaxSizeMB = 10
+//	LogMaxAgeDays = 7
+//	LogGenerations = 5
+//	LogCompress = true
+func NewLogRotator() *LogRotator {
+	r := LogRotator{
+		MaxSize:     10 * 1024 * 1024,
+		MaxAge:      7 * 24 * time.Hour,
+		Generations: 5,
+		Compress:    true,
+	}
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return &r
+	}
+
+	section := cfg.Section("Updater")
+	r.MaxSize = section.Key("LogMaxSizeMB").MustInt64(r.MaxSize/(1024*1024)) * 1024 * 1024
+	r.MaxAge = time.Duration(section.Key("LogMaxAgeDays").MustInt(int(r.MaxAge.Hours()/24))) * 24 * time.Hour
+	r.Generations = section.Key("LogGenerations").MustInt(r.Generations)
+	r.Compress = section.Key("LogCompress").MustBool(r.Compress)
+
+	return &r
+}
+
+// NeedsRotation reports if a log file is over the size limit or hasn't been
+// written for MaxAge
+func (r *LogRotator) NeedsRotation(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+
+	if r.MaxSize > 0 && info.Size() >= r.MaxSize {
+		return true
+	}
+
+	return r.MaxAge > 0 && time.Since(info.ModTime()) >= r.MaxAge
+}
+
+// Rotate moves the current log to a timestamped generation. If copyTruncate is
+// set the file is copied and truncated instead, for logs another process keeps
+// open in append mode
+func (r *LogRotator) Rotate(path string, copyTruncate bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if info.Size() > 0 {
+		ext := filepath.Ext(path)
+		generation := fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), time.Now().Unix(), ext)
+
+		if copyTruncate {
+			if err := copyFile(path, generation); err != nil {
+				return err
+			}
+			if err := os.Truncate(path, 0); err != nil {
+				return err
+			}
+		} else {
+			if err := os.Rename(path, generation); err != nil {
+				return err
+			}
+		}
+
+		// The modification time of the newest generation is the time of the last rotation
+		now := time.Now()
+		if err := os.Chtimes(generation, now, now); err != nil {
+			slog.Error("could not set the time of the rotated log", "path", generation, "error", err)
+		}
+
+		if r.Compress {
+			if err := compressFile(generation); err != nil {
+				slog.Error("could not compress log", "path", generation, "error", err)
+			}
+		}
+	}
+
+	return r.removeOldGenerations(path)
+}
+
+type generation struct {
+	path    string
+	modTime time.Time
+}
+
+// generations returns the rotated files of a log, the newest first
+func generations(path string) ([]generation, error) {
+	ext := filepath.Ext(path)
+	matches, err := filepath.Glob(strings.TrimSuffix(path, ext) + ".*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	files := []generation{}
+	for _, g := range matches {
+		if info, err := os.Stat(g); err == nil {
+			files = append(files, generation{path: g, modTime: info.ModTime()})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	return files, nil
+}
+
+// removeOldGenerations keeps the newest Generations files and removes those older than MaxAge
+func (r *LogRotator) removeOldGenerations(path string) error {
+	files, err := generations(path)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range files {
+		expired := r.MaxAge > 0 && time.Since(f.modTime) > r.MaxAge
+		if i >= r.Generations || expired {
+			if err := os.Remove(f.path); err != nil {
+				slog.Error("could not remove old log", "path", f.path, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	in.Close()
+	return os.Remove(path)
+}
+
+// RotateLogs rotates the updater log, which the updater keeps open in append
+// mode so it's copied and truncated. The agent doesn't append to its log so
+// it can only be moved while the agent is stopped, that's left for the next
+// time the agent is restarted
+func (us *UpdaterService) RotateLogs() {
+	if us.Logger != nil && us.Logger.LogFile != nil {
+		l := us.Logger.LogFile.Name()
+		if us.LogRotator.NeedsRotation(l) {
+			if err := us.LogRotator.Rotate(l, true); err != nil {
+				slog.Error("could not rotate log", "path", l, "error", err)
+			} else {
+				slog.Info("log has been rotated", "path", l)
+			}
+		}
+	}
+
+	if us.LogRotator.NeedsRotation(AgentLogFile) {
+		slog.Debug("the agent log will be rotated when the agent is restarted", "path", AgentLogFile)
+	}
+}
+
+// rotateAgentLog rotates the agent log if it's due, the agent must be stopped
+func (us *UpdaterService) rotateAgentLog() {
+	if us.LogRotator == nil || !us.LogRotator.NeedsRotation(AgentLogFile) {
+		return
+	}
+
+	if err := us.LogRotator.Rotate(AgentLogFile, false); err != nil {
+		slog.Error("could not rotate log", "path", AgentLogFile, "error", err)
+	} else {
+		slog.Info("log has been rotated", "path", AgentLogFile)
+	}
+}
+
+// StartLogRotationJob checks the logs every 15 minutes
+func (us *UpdaterService) StartLogRotationJob() error {
+	var err error
+
+	if us.LogRotator == nil {
+		us.LogRotator = NewLogRotator()
+	}
+
+	us.LogRotationJob, err = us.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			time.Duration(15*time.Minute),
+		),
+		gocron.NewTask(func() {
+			us.RotateLogs()
+		}),
+		gocron.WithName("log-rotation"),
+	)
+	if err != nil {
+		return fmt.Errorf("could not start the log rotation job: %v", err)
+	}
+	slog.Info("new log rotation job has been scheduled", "every_minutes", 15)
+	return nil
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNeedsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "openuem-agent.log")
+	if err := os.WriteFile(path, []byte("log"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := LogRotator{MaxSize: 1024, MaxAge: time.Hour, Generations: 2}
+
+	if r.NeedsRotation(path) {
+		t.Error("a log that has never been rotated is not due")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if !r.NeedsRotation(path) {
+		t.Error("a log that hasn't been written for longer than MaxAge should be rotated")
+	}
+
+	if err := r.Rotate(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !r.NeedsRotation(path) {
+		t.Error("a log over MaxSize should be rotated")
+	}
+
+	if files, err := generations(path); err != nil || len(files) != 1 {
+		t.Errorf("expected one generation, got %v, %v", files, err)
+	}
+}
+
+func TestRotateLogsDoesntStopTheAgent(t *testing.T) {
+	path := withAgentLog(t, time.Now())
+	services := NewFakeServiceController(AgentServiceName)
+	us := UpdaterService{Services: services, LogRotator: &LogRotator{MaxSize: 1, MaxAge: time.Nanosecond, Generations: 2}}
+
+	us.RotateLogs()
+
+	if actions := services.Actions(); len(actions) > 0 {
+		t.Errorf("rotating the logs shouldn't touch the agent, got %q", actions)
+	}
+	if files, err := generations(path); err != nil || len(files) > 0 {
+		t.Errorf("the agent log should wait for the next restart, got %v, %v", files, err)
+	}
+}
+
+func TestRestartServiceRotatesTheAgentLog(t *testing.T) {
+	path := withAgentLog(t, time.Now())
+	services := NewFakeServiceController(AgentServiceName)
+	us := UpdaterService{Services: services, LogRotator: &LogRotator{MaxSize: 1, MaxAge: time.Hour, Generations: 2}}
+
+	if err := us.RestartService(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, err := generations(path); err != nil || len(files) != 1 {
+		t.Errorf("expected one generation of the agent log, got %v, %v", files, err)
+	}
+}
+
+func TestRotateCopyTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "openuem-updater.log")
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString("before rotation\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := LogRotator{Generations: 2}
+	if err := r.Rotate(path, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteString("after\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "after\n" {
+		t.Errorf("the log has %q after rotation", data)
+	}
+}
@@ -0,0 +1,290 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// TimeWindow is a daily time range active on some days of the week. A range
+// whose end is before its start crosses midnight and belongs to the day it starts
+type TimeWindow struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// MaintenancePolicy restricts when updates can be installed. If there are
+// maintenance windows updates only run inside one of them, and they never run
+// inside a blackout period
+type MaintenancePolicy struct {
+	Windows   []TimeWindow
+	Blackouts []TimeWindow
+}
+
+// MaintenanceOverride holds the optional maintenance settings sent with an
+// update request, they replace the ones in the INI file
+type MaintenanceOverride struct {
+	MaintenanceWindows *string `json:"maintenance_windows,omitempty"`
+	BlackoutPeriods    *string `json:"blackout_periods,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ReadMaintenancePolicy reads the MaintenanceWindows and BlackoutPeriods keys
+// from the Updater section of the agent's INI file, e.g:
+//
+//	[Updater]
+//	MaintenanceWindows = Mon-Fri 02:00-05:00; Sat,Sun 00:00-24:00
+//	BlackoutPeriods = Mon-Fri 08:00-18:00
+func ReadMaintenancePolicy() (MaintenancePolicy, error) {
+	policy := MaintenancePolicy{}
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return policy, err
+	}
+
+	policy.Windows, err = ParseTimeWindows(cfg.Section("Updater").Key("MaintenanceWindows").String())
+	if err != nil {
+		return policy, fmt.Errorf("could not parse MaintenanceWindows, reason: %v", err)
+	}
+
+	policy.Blackouts, err = ParseTimeWindows(cfg.Section("Updater").Key("BlackoutPeriods").String())
+	if err != nil {
+		return policy, fmt.Errorf("could not parse BlackoutPeriods, reason: %v", err)
+	}
+
+	return policy, nil
+}
+
+// MaintenancePolicyRetryDelay is how long an update waits when the maintenance
+// policy can't be read, it's not run until the policy is fixed
+var MaintenancePolicyRetryDelay = 15 * time.Minute
+
+// ReadMaintenanceOverride reads the maintenance settings found in an update request payload
+func ReadMaintenanceOverride(payload []byte) (MaintenanceOverride, error) {
+	override := MaintenanceOverride{}
+	if err := json.Unmarshal(payload, &override); err != nil {
+		return override, fmt.Errorf("could not read maintenance settings from request, reason: %v", err)
+	}
+
+	if _, err := (MaintenancePolicy{}).WithOverride(override); err != nil {
+		return override, err
+	}
+	return override, nil
+}
+
+// RequestMaintenancePolicy reads the maintenance policy and applies the
+// settings of an update request. The errors of the request settings are
+// permanent, those of the INI file can be fixed
+func RequestMaintenancePolicy(override MaintenanceOverride) (MaintenancePolicy, error) {
+	policy, err := ReadMaintenancePolicy()
+	if err != nil {
+		return policy, err
+	}
+
+	policy, err = policy.WithOverride(override)
+	if err != nil {
+		return policy, Permanent(err)
+	}
+	return policy, nil
+}
+
+// WithOverride applies the maintenance settings of an update request
+func (p MaintenancePolicy) WithOverride(override MaintenanceOverride) (MaintenancePolicy, error) {
+	var err error
+
+	if override.MaintenanceWindows != nil {
+		p.Windows, err = ParseTimeWindows(*override.MaintenanceWindows)
+		if err != nil {
+			return p, fmt.Errorf("could not parse maintenance_windows, reason: %v", err)
+		}
+	}
+
+	if override.BlackoutPeriods != nil {
+		p.Blackouts, err = ParseTimeWindows(*override.BlackoutPeriods)
+		if err != nil {
+			return p, fmt.Errorf("could not parse blackout_periods, reason: %v", err)
+		}
+	}
+
+	return p, nil
+}
+
+// ParseTimeWindows parses a list of windows separated by semicolons. Each
+// window is an optional list of days (Mon,Wed or Mon-Fri) and a time range
+func ParseTimeWindows(value string) ([]TimeWindow, error) {
+	windows := []TimeWindow{}
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		w := TimeWindow{}
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 1:
+			for i := range w.Days {
+				w.Days[i] = true
+			}
+		case 2:
+			if err := w.parseDays(fields[0]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid window %q", entry)
+		}
+
+		start, end, found := strings.Cut(fields[len(fields)-1], "-")
+		if !found {
+			return nil, fmt.Errorf("invalid time range in window %q", entry)
+		}
+
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, err
+		}
+		if w.Start == w.End {
+			return nil, fmt.Errorf("empty time range in window %q", entry)
+		}
+
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+func (w *TimeWindow) parseDays(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(strings.ToLower(part), "-")
+
+		first, ok := weekdays[from]
+		if !ok {
+			return fmt.Errorf("invalid day %q", from)
+		}
+
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return fmt.Errorf("invalid day %q", to)
+			}
+		}
+
+		for d := first; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock converts HH:MM to minutes since midnight, 24:00 is accepted as an end time
+func parseClock(value string) (int, error) {
+	h, m, found := strings.Cut(value, ":")
+	if !found {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	hour, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	minute, err := strconv.Atoi(m)
+	if err != nil || minute < 0 || minute > 59 || hour < 0 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	return hour*60 + minute, nil
+}
+
+func (w TimeWindow) contains(t time.Time) bool {
+	offset := t.Hour()*60 + t.Minute()
+
+	if w.Start < w.End {
+		return w.Days[t.Weekday()] && offset >= w.Start && offset < w.End
+	}
+
+	// The window crosses midnight
+	if w.Days[t.Weekday()] && offset >= w.Start {
+		return true
+	}
+	return w.Days[(t.Weekday()+6)%7] && offset < w.End
+}
+
+func at(day time.Time, minutes int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minutes/60, minutes%60, 0, 0, day.Location())
+}
+
+// IsOpen reports if an update can run at t
+func (p MaintenancePolicy) IsOpen(t time.Time) bool {
+	for _, b := range p.Blackouts {
+		if b.contains(t) {
+			return false
+		}
+	}
+
+	if len(p.Windows) == 0 {
+		return true
+	}
+
+	for _, w := range p.Windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextRun returns the first time from t when an update can run. The zero time
+// is returned if the policy never allows an update
+func (p MaintenancePolicy) NextRun(t time.Time) time.Time {
+	if p.IsOpen(t) {
+		return t
+	}
+
+	// The policy state only changes when a window opens or a blackout ends
+	candidates := []time.Time{}
+	for i := 0; i <= 8; i++ {
+		day := t.AddDate(0, 0, i)
+		for _, w := range p.Windows {
+			candidates = append(candidates, at(day, w.Start))
+		}
+		for _, b := range p.Blackouts {
+			candidates = append(candidates, at(day, b.End))
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+
+	for _, c := range candidates {
+		if c.After(t) && p.IsOpen(c) {
+			return c
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// monday is a Monday in the local time zone
+var monday = time.Date(2026, time.October, 12, 0, 0, 0, 0, time.Local)
+
+func on(day time.Weekday, hour, minute int) time.Time {
+	return monday.AddDate(0, 0, (int(day)+6)%7).Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+}
+
+func mustParseTimeWindows(t *testing.T, value string) []TimeWindow {
+	t.Helper()
+
+	windows, err := ParseTimeWindows(value)
+	if err != nil {
+		t.Fatalf("%q: %v", value, err)
+	}
+	return windows
+}
+
+func TestParseTimeWindows(t *testing.T) {
+	windows := mustParseTimeWindows(t, " Mon-Wed,Fri 02:00-05:30 ; 22:00-24:00;")
+	if len(windows) != 2 {
+		t.Fatalf("expected 2 windows, got %+v", windows)
+	}
+
+	weekdays := [7]bool{false, true, true, true, false, true, false}
+	if windows[0].Days != weekdays || windows[0].Start != 120 || windows[0].End != 330 {
+		t.Errorf("got window %+v", windows[0])
+	}
+	if windows[1].Days != [7]bool{true, true, true, true, true, true, true} || windows[1].Start != 22*60 || windows[1].End != 24*60 {
+		t.Errorf("a window without days should be active every day until midnight, got %+v", windows[1])
+	}
+
+	if windows := mustParseTimeWindows(t, ""); len(windows) != 0 {
+		t.Errorf("an empty value has no windows, got %+v", windows)
+	}
+
+	for _, value := range []string{
+		"02:00",
+		"Mon 02:00-05:00 extra",
+		"Monday 02:00-05:00",
+		"Mon-Someday 02:00-05:00",
+		"02:00-02:00",
+		"25:00-26:00",
+		"02:60-03:00",
+		"24:30-01:00",
+		"2-5",
+		"aa:00-05:00",
+	} {
+		if _, err := ParseTimeWindows(value); err == nil {
+			t.Errorf("%q should be rejected", value)
+		}
+	}
+}
+
+func TestTimeWindowWrappingDays(t *testing.T) {
+	windows := mustParseTimeWindows(t, "Fri-Mon 10:00-12:00")
+
+	for day, active := range map[time.Weekday]bool{
+		time.Friday: true, time.Saturday: true, time.Sunday: true, time.Monday: true,
+		time.Tuesday: false, time.Wednesday: false, time.Thursday: false,
+	} {
+		if windows[0].contains(on(day, 11, 0)) != active {
+			t.Errorf("on %s the window should be active: %t", day, active)
+		}
+	}
+}
+
+func TestTimeWindowCrossingMidnight(t *testing.T) {
+	w := mustParseTimeWindows(t, "Fri 22:00-02:00")[0]
+
+	tests := []struct {
+		at     time.Time
+		active bool
+	}{
+		{on(time.Friday, 21, 59), false},
+		{on(time.Friday, 22, 0), true},
+		{on(time.Friday, 23, 59), true},
+		{on(time.Saturday, 1, 59), true},
+		{on(time.Saturday, 2, 0), false},
+		{on(time.Saturday, 23, 0), false},
+		{on(time.Friday, 1, 0), false},
+	}
+
+	for _, tt := range tests {
+		if w.contains(tt.at) != tt.active {
+			t.Errorf("at %s the window should be active: %t", tt.at.Format("Mon 15:04"), tt.active)
+		}
+	}
+}
+
+func TestMaintenancePolicyIsOpen(t *testing.T) {
+	policy := MaintenancePolicy{
+		Windows:   mustParseTimeWindows(t, "Mon-Fri 02:00-05:00; Sat,Sun 00:00-24:00"),
+		Blackouts: mustParseTimeWindows(t, "Sun 12:00-14:00"),
+	}
+
+	tests := []struct {
+		at   time.Time
+		open bool
+	}{
+		{on(time.Monday, 3, 0), true},
+		{on(time.Monday, 5, 0), false},
+		{on(time.Saturday, 23, 59), true},
+		{on(time.Sunday, 13, 0), false},
+		{on(time.Sunday, 14, 0), true},
+	}
+
+	for _, tt := range tests {
+		if policy.IsOpen(tt.at) != tt.open {
+			t.Errorf("at %s the policy should be open: %t", tt.at.Format("Mon 15:04"), tt.open)
+		}
+	}
+
+	if !(MaintenancePolicy{}).IsOpen(on(time.Wednesday, 12, 0)) {
+		t.Error("an empty policy should always be open")
+	}
+}
+
+func TestMaintenancePolicyNextRun(t *testing.T) {
+	policy := MaintenancePolicy{
+		Windows:   mustParseTimeWindows(t, "Mon-Fri 02:00-05:00"),
+		Blackouts: mustParseTimeWindows(t, "Wed 00:00-24:00"),
+	}
+
+	tests := []struct {
+		from, next time.Time
+	}{
+		{on(time.Monday, 3, 0), on(time.Monday, 3, 0)},
+		{on(time.Monday, 6, 0), on(time.Tuesday, 2, 0)},
+		{on(time.Tuesday, 6, 0), on(time.Thursday, 2, 0)},
+		{on(time.Friday, 6, 0), on(time.Monday, 2, 0).AddDate(0, 0, 7)},
+	}
+
+	for _, tt := range tests {
+		if next := policy.NextRun(tt.from); !next.Equal(tt.next) {
+			t.Errorf("from %s the next run should be %s, got %s", tt.from.Format("Mon 15:04"), tt.next.Format("Mon 02 15:04"), next.Format("Mon 02 15:04"))
+		}
+	}
+
+	// A blackout ending when a window opens
+	policy = MaintenancePolicy{Blackouts: mustParseTimeWindows(t, "08:00-18:00")}
+	if next := policy.NextRun(on(time.Monday, 9, 0)); !next.Equal(on(time.Monday, 18, 0)) {
+		t.Errorf("the next run should be when the blackout ends, got %s", next)
+	}
+
+	never := []MaintenancePolicy{
+		{Blackouts: mustParseTimeWindows(t, "00:00-24:00")},
+		{Windows: mustParseTimeWindows(t, "Sat 02:00-05:00"), Blackouts: mustParseTimeWindows(t, "Sat 00:00-24:00")},
+	}
+	for _, p := range never {
+		if next := p.NextRun(on(time.Monday, 9, 0)); !next.IsZero() {
+			t.Errorf("a policy that never allows an update should return the zero time, got %s", next)
+		}
+	}
+}
+
+func TestMaintenancePolicyWithOverride(t *testing.T) {
+	policy := MaintenancePolicy{
+		Windows:   mustParseTimeWindows(t, "Mon-Fri 02:00-05:00"),
+		Blackouts: mustParseTimeWindows(t, "Sun 00:00-24:00"),
+	}
+
+	override, err := ReadMaintenanceOverride([]byte(`{"version": "1.2.0", "blackout_periods": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := policy.WithOverride(override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Windows) != 1 || len(p.Blackouts) != 0 {
+		t.Errorf("only the blackouts should be replaced, got %+v", p)
+	}
+
+	if p, err := policy.WithOverride(MaintenanceOverride{}); err != nil || len(p.Windows) != 1 || len(p.Blackouts) != 1 {
+		t.Errorf("a request without settings should keep the policy, got %+v, %v", p, err)
+	}
+
+	for _, payload := range []string{
+		`{"maintenance_windows": "Someday 02:00-05:00"}`,
+		`{"blackout_periods": 8}`,
+	} {
+		if _, err := ReadMaintenanceOverride([]byte(payload)); err == nil {
+			t.Errorf("%s should be rejected", payload)
+		}
+	}
+}
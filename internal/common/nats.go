@@ -1,25 +1,46 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	openuem_nats "github.com/open-uem/nats"
 )
 
+// NATSDrainTimeout is how long we wait for the subscriptions and the
+// consumer to process their pending messages when the connection is closed
+var NATSDrainTimeout = 30 * time.Second
+
+// AgentsStream is the JetStream stream created by the server for the agents
+const AgentsStream = "AGENTS_STREAM"
+
+var (
+	// UpdateAckWait is how long the server waits for an ack or a heartbeat
+	// before delivering an update request again
+	UpdateAckWait = 5 * time.Minute
+	// UpdateMaxAckPending is the number of requests that can be unacked at once
+	UpdateMaxAckPending = 10
+	// UpdateHeartbeatInterval is how often a running update tells the server
+	// it's still working on its request
+	UpdateHeartbeatInterval = time.Minute
+)
+
 func (us *UpdaterService) StartNATSConnectJob(queueSubscribe func() error) error {
 	var err error
 
-	us.NATSConnection, err = openuem_nats.ConnectWithNATS(us.NATSServers, us.AgentCert, us.AgentKey, us.CACert, us.WebsocketPort)
+	err = us.connect(queueSubscribe)
 	if err == nil {
-		if err := queueSubscribe(); err == nil {
-			return err
-		}
 		return nil
 	}
-	log.Printf("[ERROR]: could not connect to NATS %v", err)
+	slog.Error("could not connect to NATS", "error", err)
 
 	us.NATSConnectJob, err = us.TaskScheduler.NewJob(
 		gocron.DurationJob(
@@ -27,15 +48,8 @@ func (us *UpdaterService) StartNATSConnectJob(queueSubscribe func() error) error
 		),
 		gocron.NewTask(
 			func() {
-				if us.NATSConnection == nil {
-					us.NATSConnection, err = openuem_nats.ConnectWithNATS(us.NATSServers, us.AgentCert, us.AgentKey, us.CACert, us.WebsocketPort)
-					if err != nil {
-						log.Printf("[ERROR]: could not connect to NATS %v", err)
-						return
-					}
-				}
-
-				if err := queueSubscribe(); err != nil {
+				if err := us.connect(queueSubscribe); err != nil {
+					slog.Error("could not connect to NATS", "error", err)
 					return
 				}
 
@@ -44,10 +58,402 @@ func (us *UpdaterService) StartNATSConnectJob(queueSubscribe func() error) error
 				}
 			},
 		),
+		gocron.WithName("nats-connect"),
 	)
 	if err != nil {
 		return fmt.Errorf("could not start the NATS connect job: %v", err)
 	}
-	log.Printf("[INFO]: new NATS connect job has been scheduled every %d minutes", 2)
+	slog.Info("new NATS connect job has been scheduled", "every_minutes", 2)
+	return nil
+}
+
+// connection returns the current NATS connection, nil if there's none. It's
+// replaced by connect and closeConnection at any time, so callers keep the
+// returned value instead of reading the field again
+func (us *UpdaterService) connection() *nats.Conn {
+	us.connMu.Lock()
+	defer us.connMu.Unlock()
+
+	return us.NATSConnection
+}
+
+// connected returns the current NATS connection if it's connected, nil otherwise
+func (us *UpdaterService) connected() *nats.Conn {
+	nc := us.connection()
+	if nc == nil || !nc.IsConnected() {
+		return nil
+	}
+	return nc
+}
+
+// connect opens the connection if needed and subscribes to our subjects.
+// If a subscription fails the ones already created are removed so the
+// next attempt starts from scratch
+func (us *UpdaterService) connect(queueSubscribe func() error) error {
+	if us.certificateExpired() {
+		return errors.New("the agent certificate has expired, waiting until it's renewed")
+	}
+
+	if us.connection() == nil {
+		c := us.Config()
+		nc, err := openuem_nats.ConnectWithNATS(c.NATSServers, c.AgentCert, c.AgentKey, c.CACert, c.WebsocketPort)
+		if err != nil {
+			return err
+		}
+		us.setConnectionHandlers(nc)
+
+		us.connMu.Lock()
+		current := us.NATSConnection
+		if current == nil {
+			us.NATSConnection = nc
+		}
+		us.connMu.Unlock()
+
+		// Another connect won the race, keep its connection
+		if current != nil {
+			nc.Close()
+		}
+	}
+
+	if err := queueSubscribe(); err != nil {
+		us.unsubscribeAll()
+		return err
+	}
+	return nil
+}
+
+// setConnectionHandlers replaces the handlers set by ConnectWithNATS. The
+// client reconnects by itself after a disconnection, if the connection is
+// closed for good we start connecting again
+func (us *UpdaterService) setConnectionHandlers(nc *nats.Conn) {
+	nc.SetDisconnectErrHandler(func(nc *nats.Conn, err error) {
+		slog.Warn("disconnected from the message broker, reconnecting", "error", err)
+	})
+
+	nc.SetReconnectHandler(func(nc *nats.Conn) {
+		slog.Info("reconnected to the message broker", "server", nc.ConnectedUrlRedacted())
+
+		// Publish the events stored while we were offline
+		us.FlushEventOutbox()
+
+		// The consumer may have been lost while we were away
+		us.connMu.Lock()
+		lost := us.ConsumeContext == nil
+		us.connMu.Unlock()
+		if lost {
+			if err := us.StartJetStreamConsumerJob(); err != nil {
+				slog.Error("could not create the JetStream consumer again", "error", err)
+			}
+		}
+	})
+
+	nc.SetClosedHandler(func(closed *nats.Conn) {
+		// Connections we close ourselves are no longer the current one
+		if closed != us.connection() {
+			return
+		}
+
+		slog.Error("the connection to the message broker has been closed", "error", closed.LastError())
+		us.closeConnection(0)
+		if err := us.StartNATSConnectJob(us.queueSubscribe); err != nil {
+			slog.Error("could not start the NATS connect job", "error", err)
+		}
+	})
+}
+
+// subscribe creates a queue subscription owned by the updater so it's drained
+// when the connection is closed
+func (us *UpdaterService) subscribe(subject string, handler nats.MsgHandler) error {
+	nc := us.connection()
+	if nc == nil {
+		return errors.New("not connected to NATS")
+	}
+
+	sub, err := nc.QueueSubscribe(subject, "openuem-agent-management", handler)
+	if err != nil {
+		return err
+	}
+
+	us.connMu.Lock()
+	us.Subscriptions = append(us.Subscriptions, sub)
+	us.connMu.Unlock()
 	return nil
 }
+
+// unsubscribeAll removes our subscriptions and stops consuming messages
+func (us *UpdaterService) unsubscribeAll() {
+	us.connMu.Lock()
+	subscriptions := us.Subscriptions
+	us.Subscriptions = nil
+	consumeContext := us.ConsumeContext
+	us.ConsumeContext = nil
+	us.connMu.Unlock()
+
+	if consumeContext != nil {
+		consumeContext.Stop()
+	}
+
+	for _, sub := range subscriptions {
+		if err := sub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			slog.Error("could not unsubscribe", "subject", sub.Subject, "error", err)
+		}
+	}
+}
+
+// closeConnection stops consuming, drains our subscriptions and the connection
+// and waits up to timeout for the messages being processed. A zero timeout
+// doesn't wait
+func (us *UpdaterService) closeConnection(timeout time.Duration) {
+	us.connMu.Lock()
+	subscriptions := us.Subscriptions
+	us.Subscriptions = nil
+	consumeContext := us.ConsumeContext
+	us.ConsumeContext = nil
+	cancel := us.JetstreamContextCancel
+	us.JetstreamContextCancel = nil
+	consumerJob := us.ConsumerJob
+	us.ConsumerJob = nil
+	nc := us.NATSConnection
+	us.NATSConnection = nil
+	us.connMu.Unlock()
+
+	if consumerJob != nil {
+		_ = us.TaskScheduler.RemoveJob(consumerJob.ID())
+	}
+
+	if cancel != nil {
+		cancel()
+	}
+
+	deadline := time.After(timeout)
+
+	if consumeContext != nil {
+		if timeout == 0 {
+			consumeContext.Stop()
+		} else {
+			consumeContext.Drain()
+			select {
+			case <-consumeContext.Closed():
+			case <-deadline:
+				slog.Error("timed out draining the JetStream consumer")
+				consumeContext.Stop()
+			}
+		}
+	}
+
+	for _, sub := range subscriptions {
+		if err := sub.Drain(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			slog.Error("could not drain subscription", "subject", sub.Subject, "error", err)
+		}
+	}
+
+	if nc == nil || nc.IsClosed() {
+		return
+	}
+
+	if timeout == 0 {
+		nc.Close()
+		return
+	}
+
+	closed := make(chan struct{})
+	nc.SetClosedHandler(func(*nats.Conn) {
+		close(closed)
+	})
+
+	if err := nc.Drain(); err != nil {
+		slog.Error("could not drain NATS connection", "error", err)
+		nc.Close()
+		return
+	}
+
+	select {
+	case <-closed:
+	case <-deadline:
+		slog.Error("timed out draining the NATS connection")
+		nc.Close()
+	}
+}
+
+// Reconnect closes the NATS connection and connects again with the current
+// settings, creating the subscriptions and the JetStream consumer again
+func (us *UpdaterService) Reconnect() error {
+	us.closeConnection(NATSDrainTimeout)
+
+	// Don't leave a connect job running with the old settings
+	if us.NATSConnectJob != nil {
+		_ = us.TaskScheduler.RemoveJob(us.NATSConnectJob.ID())
+		us.NATSConnectJob = nil
+	}
+
+	return us.StartNATSConnectJob(us.queueSubscribe)
+}
+
+// StartJetStreamConsumerJob creates the JetStream consumer now and retries
+// every minute until it has been created
+func (us *UpdaterService) StartJetStreamConsumerJob() error {
+	// Don't consume again while the updater is stopping
+	if us.Stopping() {
+		return nil
+	}
+
+	us.connMu.Lock()
+	defer us.connMu.Unlock()
+
+	if us.ConsumerJob != nil {
+		return nil
+	}
+
+	job, err := us.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			time.Duration(1*time.Minute),
+		),
+		gocron.NewTask(func() {
+			if err := us.CreateUpdaterJetStreamConsumer(); err != nil {
+				slog.Error("could not create the JetStream consumer", "error", err)
+				return
+			}
+
+			us.connMu.Lock()
+			job := us.ConsumerJob
+			us.ConsumerJob = nil
+			us.connMu.Unlock()
+
+			if job != nil {
+				if err := us.TaskScheduler.RemoveJob(job.ID()); err != nil {
+					slog.Error("could not remove the JetStream consumer job", "error", err)
+				}
+			}
+		}),
+		gocron.WithName("jetstream-consumer"),
+		gocron.WithStartAt(gocron.WithStartImmediately()),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		return fmt.Errorf("could not start the JetStream consumer job: %v", err)
+	}
+	us.ConsumerJob = job
+
+	return nil
+}
+
+// UpdaterConsumerConfig is the durable consumer that delivers the update and
+// uninstall requests of an agent. It's replicated when there are several servers
+func UpdaterConsumerConfig(agentID, natsServers string) jetstream.ConsumerConfig {
+	consumerConfig := jetstream.ConsumerConfig{
+		Durable:        "AgentUpdater" + agentID,
+		FilterSubjects: []string{"agent.update." + agentID, "agent.uninstall." + agentID},
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        UpdateAckWait,
+		MaxAckPending:  UpdateMaxAckPending,
+	}
+
+	if servers := len(strings.Split(natsServers, ",")); servers > 1 {
+		consumerConfig.Replicas = int(math.Min(float64(servers), 5))
+	}
+
+	return consumerConfig
+}
+
+func (us *UpdaterService) CreateUpdaterJetStreamConsumer() error {
+	nc := us.connection()
+	if nc == nil {
+		return errors.New("not connected to NATS")
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("could not instantiate JetStream: %v", err)
+	}
+	slog.Info("JetStream has been instantiated")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	us.connMu.Lock()
+	us.JetstreamContextCancel = cancel
+	us.connMu.Unlock()
+
+	s, err := js.Stream(ctx, AgentsStream)
+	if err != nil {
+		return fmt.Errorf("could not create stream %s: %v", AgentsStream, err)
+	}
+
+	c1, err := s.CreateOrUpdateConsumer(ctx, UpdaterConsumerConfig(us.AgentId, us.Config().NATSServers))
+	if err != nil {
+		return fmt.Errorf("could not create Jetstream consumer: %v", err)
+	}
+
+	consumeContext, err := c1.Consume(us.JetStreamUpdaterHandler, jetstream.ConsumeErrHandler(us.consumeErrHandler))
+	if err != nil {
+		return fmt.Errorf("could not start consuming messages: %v", err)
+	}
+
+	// Replace the previous consume context, if any
+	us.connMu.Lock()
+	previous := us.ConsumeContext
+	us.ConsumeContext = consumeContext
+	us.JetstreamContextCancel = nil
+	us.connMu.Unlock()
+
+	if previous != nil {
+		previous.Stop()
+	}
+
+	slog.Info("Jetstream created and started consuming messages")
+	slog.Info("subscribed to message", "subject", fmt.Sprintf("agent.update.%s", us.AgentId))
+	slog.Info("subscribed to message", "subject", fmt.Sprintf("agent.uninstall.%s", us.AgentId))
+	return nil
+}
+
+// keepInProgress sends heartbeats so the server doesn't deliver the message
+// again while the update is running. It stops once the message is acked
+func keepInProgress(msg jetstream.Msg, requestID string, interval time.Duration) (stop func()) {
+	if msg == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					if !errors.Is(err, jetstream.ErrMsgAlreadyAckd) {
+						slog.Error("could not send the in progress heartbeat", "request_id", requestID, "error", err)
+					}
+					return
+				}
+				slog.Debug("in progress heartbeat sent", "request_id", requestID)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// consumeErrHandler creates the consumer again if the server has lost it
+func (us *UpdaterService) consumeErrHandler(consumeCtx jetstream.ConsumeContext, err error) {
+	if !errors.Is(err, jetstream.ErrConsumerDeleted) && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		slog.Error("consumer error", "error", err)
+		return
+	}
+
+	slog.Error("the JetStream consumer has been lost, creating it again", "error", err)
+
+	us.connMu.Lock()
+	if us.ConsumeContext == consumeCtx {
+		us.ConsumeContext = nil
+	}
+	us.connMu.Unlock()
+	consumeCtx.Stop()
+
+	if err := us.StartJetStreamConsumerJob(); err != nil {
+		slog.Error("could not create the JetStream consumer again", "error", err)
+	}
+}
@@ -0,0 +1,506 @@
+//go:build linux
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	openuem_nats "github.com/open-uem/nats"
+)
+
+// natsTest is a handlerTest whose updater is connected with its agent
+// certificate to an in-process JetStream server that requires TLS
+type natsTest struct {
+	*handlerTest
+	server *server.Server
+	client *nats.Conn
+	js     jetstream.JetStream
+}
+
+func newNATSTest(t *testing.T, installedVersion string) *natsTest {
+	t.Helper()
+
+	pki := newTestPKI(t)
+	serverCert, serverKey := pki.issue(t, "server", time.Now().Add(-time.Hour), time.Now().Add(time.Hour), true)
+	agentCert, agentKey := pki.issue(t, "agent", time.Now().Add(-time.Hour), time.Now().Add(time.Hour), false)
+
+	tlsConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{CertFile: serverCert, KeyFile: serverKey, CaFile: pki.CACert, Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		TLS:       true,
+		TLSVerify: true,
+		TLSConfig: tlsConfig,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+
+	n := natsTest{handlerTest: newHandlerTest(t, installedVersion, ""), server: s}
+	servers := fmt.Sprintf("tls://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	// The server side uses the same CA, like the OpenUEM console
+	if n.client, err = openuem_nats.ConnectWithNATS(servers, agentCert, agentKey, pki.CACert, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.client.Close)
+
+	if n.js, err = jetstream.New(n.client); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.js.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:     AgentsStream,
+		Subjects: []string{"agent.update.*", "agent.uninstall.*"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	retryPolicy, ackWait := DefaultRetryPolicy, UpdateAckWait
+	DefaultRetryPolicy = RetryPolicy{MaxDeliveries: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	UpdateAckWait = 30 * time.Second
+	t.Cleanup(func() { DefaultRetryPolicy, UpdateAckWait = retryPolicy, ackWait })
+
+	n.us.SetConfig(Config{AgentID: testAgentID, NATSServers: servers, CACert: pki.CACert, AgentCert: agentCert, AgentKey: agentKey})
+	n.writeConfig(t, n.us.Config())
+
+	if err := n.us.StartNATSConnectJob(n.us.queueSubscribe); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.us.closeConnection(time.Second) })
+
+	Eventually(t, 10*time.Second, func() bool {
+		n.us.connMu.Lock()
+		defer n.us.connMu.Unlock()
+		return n.us.ConsumeContext != nil
+	}, "the updater hasn't started consuming")
+
+	return &n
+}
+
+// writeConfig saves the connection settings in the agent's INI file
+func (n *natsTest) writeConfig(t *testing.T, c Config) {
+	t.Helper()
+
+	data := fmt.Sprintf("[Agent]\nUUID = %s\n\n[NATS]\nNATSServers = %s\n\n[Certificates]\nCACert = %s\nAgentCert = %s\nAgentKey = %s\n",
+		c.AgentID, c.NATSServers, c.CACert, c.AgentCert, c.AgentKey)
+	if err := os.WriteFile(n.ini, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// publish sends a request to the agent's stream, JetStream uses the request
+// ID to drop duplicates
+func (n *natsTest) publish(t *testing.T, subject, requestID string, request any) {
+	t.Helper()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := nats.NewMsg(subject + "." + testAgentID)
+	msg.Data = data
+	msg.Header.Set(jetstream.MsgIDHeader, requestID)
+	if _, err := n.js.PublishMsg(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// consumer returns the state of the updater's consumer
+func (n *natsTest) consumer(t *testing.T) *jetstream.ConsumerInfo {
+	t.Helper()
+
+	c, err := n.js.Consumer(context.Background(), AgentsStream, "AgentUpdater"+testAgentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// waitForAcks waits until the consumer has delivered and got the acks of the
+// given number of messages
+func (n *natsTest) waitForAcks(t *testing.T, messages uint64) *jetstream.ConsumerInfo {
+	t.Helper()
+
+	var info *jetstream.ConsumerInfo
+	Eventually(t, 10*time.Second, func() bool {
+		info = n.consumer(t)
+		return info.AckFloor.Stream == messages && info.NumAckPending == 0 && info.NumPending == 0
+	}, "the messages haven't been acked")
+	return info
+}
+
+func TestJetStreamUpdateIsAcked(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+	n.installs("1.2.0-1")
+
+	events, err := n.client.SubscribeSync("agent.update.status." + testAgentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.publish(t, "agent.update", "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true})
+
+	info := n.waitForAcks(t, 1)
+	if info.NumRedelivered != 0 || info.Delivered.Consumer != 1 {
+		t.Errorf("the update should be delivered once, got %+v", info.Delivered)
+	}
+
+	n.waitForRequest(t, "request-1", REQUEST_SUCCEEDED)
+	if status, result := n.iniStatus(t); status != openuem_nats.UPDATE_SUCCESS {
+		t.Errorf("the INI status is %s, %s", status, result)
+	}
+
+	phases := []string{}
+	for !slices.Contains(phases, UPDATE_PHASE_SUCCEEDED) {
+		msg, err := events.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("the succeeded event hasn't been published, got %q: %v", phases, err)
+		}
+		e := UpdateStatusEvent{}
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			t.Fatal(err)
+		}
+		phases = append(phases, e.Phase)
+	}
+}
+
+func TestJetStreamFailedUpdateIsRedelivered(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+	n.deferred.Errors = map[string]error{"apt install -y --allow-downgrades openuem-agent=1.2.0-1": os.ErrPermission}
+
+	deadLetters, err := n.client.SubscribeSync("agent.update.deadletter." + testAgentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.publish(t, "agent.update", "request-1", openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateNow: true})
+
+	// Two NAKs and the request is given up on the third delivery
+	msg, err := deadLetters.NextMsg(10 * time.Second)
+	if err != nil {
+		t.Fatalf("no dead letter has been published: %v", err)
+	}
+
+	deadLetter := DeadLetter{}
+	if err := json.Unmarshal(msg.Data, &deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetter.RequestID != "request-1" || deadLetter.NumDelivered != 3 || deadLetter.Permanent {
+		t.Errorf("got dead letter %+v", deadLetter)
+	}
+
+	info := n.waitForAcks(t, 1)
+	if info.Delivered.Consumer != 3 {
+		t.Errorf("the update should be delivered 3 times, got %d", info.Delivered.Consumer)
+	}
+	if installs := len(n.deferred.Commands()); installs != 3 {
+		t.Errorf("the install should be tried 3 times, got %d", installs)
+	}
+
+	n.waitForRequest(t, "request-1", REQUEST_FAILED)
+	if status, _ := n.iniStatus(t); status != openuem_nats.UPDATE_ERROR {
+		t.Errorf("the INI status is %s", status)
+	}
+}
+
+func TestJetStreamMalformedUpdateIsTerminated(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+
+	n.publish(t, "agent.update", "request-1", "not an update request")
+
+	info := n.waitForAcks(t, 1)
+	if info.Delivered.Consumer != 1 {
+		t.Errorf("a malformed request should be delivered once, got %d", info.Delivered.Consumer)
+	}
+	Eventually(t, 5*time.Second, func() bool {
+		status, _ := n.iniStatus(t)
+		return status == openuem_nats.UPDATE_ERROR
+	}, "the INI status should be error")
+}
+
+func TestJetStreamUninstallIsAcked(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+
+	n.publish(t, "agent.uninstall", "request-1", struct{}{})
+
+	n.waitForAcks(t, 1)
+	if commands := n.deferred.Commands(); !slices.Equal(commands, []string{"apt purge -y openuem-agent"}) {
+		t.Errorf("the deferred commands are %q", commands)
+	}
+}
+
+func TestRestartRequest(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+
+	if _, err := n.client.Request("agent.restart."+testAgentID, nil, 5*time.Second); err != nil {
+		t.Fatalf("the restart request hasn't been answered: %v", err)
+	}
+	if actions := n.services.Actions(); !slices.Equal(actions, []string{"stop " + AgentServiceName, "start " + AgentServiceName}) {
+		t.Errorf("the service actions are %q", actions)
+	}
+}
+
+// request sends a request to one of the updater's subjects and decodes the reply
+func (n *natsTest) request(t *testing.T, subject string, request, reply any) {
+	t.Helper()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := n.client.Request(subject+"."+testAgentID, data, 5*time.Second)
+	if err != nil {
+		t.Fatalf("the %s request hasn't been answered: %v", subject, err)
+	}
+	if err := json.Unmarshal(msg.Data, reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// schedule queues an update to be installed in an hour
+func (n *natsTest) schedule(t *testing.T, requestID string) {
+	t.Helper()
+
+	msg := n.update(t, requestID, openuem_nats.OpenUEMUpdateRequest{Version: "1.2.0-1", UpdateAt: time.Now().Add(time.Hour)}, 1)
+	if action := msg.WaitDone(t, time.Second); action != "ack" {
+		t.Fatalf("the request has been answered with %q", action)
+	}
+}
+
+func requestIDs(updates []ScheduledUpdate) []string {
+	ids := []string{}
+	for _, u := range updates {
+		ids = append(ids, u.RequestID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestCancelUpdateRequest(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+	n.schedule(t, "request-1")
+	n.schedule(t, "request-2")
+
+	reply := PendingUpdatesResponse{}
+	n.request(t, "agent.update.cancel", PendingUpdateRequest{RequestID: "request-1"}, &reply)
+
+	if reply.Error != "" {
+		t.Fatalf("the cancel request failed: %s", reply.Error)
+	}
+	if ids := requestIDs(reply.Updates); !slices.Equal(ids, []string{"request-2"}) {
+		t.Errorf("the pending updates are %q", ids)
+	}
+	n.waitForRequest(t, "request-1", REQUEST_CANCELLED)
+
+	reply = PendingUpdatesResponse{}
+	n.request(t, "agent.update.cancel", PendingUpdateRequest{RequestID: "request-3"}, &reply)
+
+	if !strings.Contains(reply.Error, "no pending update") {
+		t.Errorf("cancelling an unknown update should fail, got %q", reply.Error)
+	}
+	if ids := requestIDs(reply.Updates); !slices.Equal(ids, []string{"request-2"}) {
+		t.Errorf("the pending updates are %q", ids)
+	}
+}
+
+func TestRescheduleUpdateRequest(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+	n.schedule(t, "request-1")
+
+	updateAt := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	reply := PendingUpdatesResponse{}
+	n.request(t, "agent.update.reschedule", PendingUpdateRequest{RequestID: "request-1", UpdateAt: updateAt}, &reply)
+
+	if reply.Error != "" {
+		t.Fatalf("the reschedule request failed: %s", reply.Error)
+	}
+	if len(reply.Updates) != 1 || !reply.Updates[0].Request.UpdateAt.Equal(updateAt) {
+		t.Errorf("the update should be queued for %s, got %+v", updateAt, reply.Updates)
+	}
+	n.waitForRequest(t, "request-1", REQUEST_SCHEDULED)
+
+	reply = PendingUpdatesResponse{}
+	n.request(t, "agent.update.reschedule", PendingUpdateRequest{RequestID: "request-1"}, &reply)
+
+	if reply.Error == "" {
+		t.Error("rescheduling without a time should fail")
+	}
+}
+
+func TestListUpdatesRequest(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+
+	reply := PendingUpdatesResponse{}
+	n.request(t, "agent.update.list", nil, &reply)
+	if len(reply.Updates) > 0 {
+		t.Errorf("there shouldn't be pending updates, got %+v", reply.Updates)
+	}
+
+	n.schedule(t, "request-1")
+	n.schedule(t, "request-2")
+
+	reply = PendingUpdatesResponse{}
+	n.request(t, "agent.update.list", nil, &reply)
+	if ids := requestIDs(reply.Updates); !slices.Equal(ids, []string{"request-1", "request-2"}) {
+		t.Errorf("the pending updates are %q", ids)
+	}
+}
+
+func TestStatusRequest(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+	n.schedule(t, "request-1")
+
+	status := UpdaterStatus{}
+	n.request(t, "agent.updater.status", nil, &status)
+
+	if status.AgentID != testAgentID || status.UpdaterVersion != Version {
+		t.Errorf("unexpected agent %s or version %s", status.AgentID, status.UpdaterVersion)
+	}
+	if !status.AgentServiceRunning {
+		t.Error("the agent service should be running")
+	}
+	if status.NATSStatus != nats.CONNECTED.String() || status.NATSServer == "" {
+		t.Errorf("the NATS status is %s, %s", status.NATSStatus, status.NATSServer)
+	}
+	if ids := requestIDs(status.PendingUpdates); !slices.Equal(ids, []string{"request-1"}) {
+		t.Errorf("the pending updates are %q", ids)
+	}
+
+	names := []string{}
+	for _, job := range status.ScheduledJobs {
+		names = append(names, job.Name)
+	}
+	if !slices.Contains(names, "update-request-1") {
+		t.Errorf("the update job is missing from the scheduled jobs %q", names)
+	}
+}
+
+func TestNATSPingProbe(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+	probe := NATSPingProbe{Conn: n.us.connection(), Subject: "agent.ping." + testAgentID, Timeout: 200 * time.Millisecond}
+
+	if err := probe.Check(time.Now()); err == nil {
+		t.Error("an agent that doesn't answer is unhealthy")
+	}
+
+	sub, err := n.client.Subscribe("agent.ping."+testAgentID, func(msg *nats.Msg) {
+		_ = msg.Respond(nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	if err := n.client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := probe.Check(time.Now()); err != nil {
+		t.Errorf("the agent answered, got %v", err)
+	}
+	if err := (NATSPingProbe{Subject: "agent.ping." + testAgentID}).Check(time.Now()); err != nil {
+		t.Errorf("the agent isn't blamed while the updater is disconnected, got %v", err)
+	}
+}
+
+func TestReconnectWhilePublishing(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				n.us.PublishUpdateStatus("request-1", UPDATE_PHASE_RECEIVED, nil, nil, "")
+			}
+		}
+	}()
+
+	for range 3 {
+		if err := n.us.Reconnect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	Eventually(t, 10*time.Second, func() bool {
+		return n.us.connected() != nil
+	}, "the updater hasn't connected again")
+}
+
+func TestReloadConfigWhileConnected(t *testing.T) {
+	n := newNATSTest(t, "1.0.0-1")
+	n.us.ConfigWatcher = NewConfigWatcher(n.us.configFiles())
+	n.us.CertificateMonitor = NewCertificateMonitor()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				n.us.PublishUpdateStatus("request-1", UPDATE_PHASE_RECEIVED, nil, nil, "")
+				n.us.CheckCertificates()
+			}
+		}
+	}()
+
+	// The connect job reads the settings while they're replaced
+	c := n.us.Config()
+	port := n.server.Addr().(*net.TCPAddr).Port
+	for _, host := range []string{"localhost", "127.0.0.1", "localhost"} {
+		c.NATSServers = fmt.Sprintf("tls://%s:%d", host, port)
+		n.writeConfig(t, c)
+		n.us.ReloadConfig(nil)
+	}
+	close(done)
+	wg.Wait()
+
+	if servers := n.us.Config().NATSServers; servers != c.NATSServers {
+		t.Errorf("the NATS servers are %s, expected %s", servers, c.NATSServers)
+	}
+	Eventually(t, 10*time.Second, func() bool {
+		nc := n.us.connected()
+		return nc != nil && nc.ConnectedUrl() == c.NATSServers
+	}, "the updater hasn't connected with the new settings")
+}
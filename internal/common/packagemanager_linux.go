@@ -0,0 +1,469 @@
+//go:build linux
+
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const AgentPackage = "openuem-agent"
+
+const OSReleaseFile = "/etc/os-release"
+
+const maxVersionLength = 128
+
+// Version grammars accepted by each package manager, an empty version means latest
+var (
+	debianVersion = regexp.MustCompile(`^([0-9]+:)?[0-9][A-Za-z0-9.+~]*(-[A-Za-z0-9.+~]+)?$`)
+	rpmVersion    = regexp.MustCompile(`^([0-9]+:)?[A-Za-z0-9._+~^]+(-[A-Za-z0-9._+~^]+)?$`)
+	pacmanVersion = regexp.MustCompile(`^([0-9]+:)?[A-Za-z0-9._+]+(-[0-9.]+)?$`)
+)
+
+func validateVersion(grammar *regexp.Regexp, version string) error {
+	if version == "" {
+		return nil
+	}
+	if len(version) > maxVersionLength || !grammar.MatchString(version) {
+		return fmt.Errorf("invalid package version %q", version)
+	}
+	return nil
+}
+
+// PackageManager abstracts the package management tool of a Linux distribution.
+// Refresh and InstalledVersion run immediately, Install, InstallFile and Remove
+// are handed to the deferred runner so they survive the updater being restarted
+// by the package scripts. InstallFile installs a local package whose file name
+// ends with PackageExtension
+type PackageManager interface {
+	Name() string
+	Refresh() error
+	ValidateVersion(version string) error
+	Install(pkg, version string) error
+	InstallFile(path string) error
+	PackageExtension() string
+	Remove(pkg string) error
+	InstalledVersion(pkg string) (string, error)
+}
+
+// PackageManagerFactory creates a package manager. The runner is used for
+// commands that must run now, the deferred runner for install and remove
+type PackageManagerFactory func(runner, deferred CommandRunner) PackageManager
+
+var packageManagers = map[string]PackageManagerFactory{}
+
+// RegisterPackageManager associates an /etc/os-release ID with a package manager
+func RegisterPackageManager(id string, factory PackageManagerFactory) {
+	packageManagers[id] = factory
+}
+
+func init() {
+	for _, id := range []string{"debian", "ubuntu", "linuxmint", "neon", "pop", "elementary", "zorin", "kali", "raspbian"} {
+		RegisterPackageManager(id, NewAptPackageManager)
+	}
+	for _, id := range []string{"fedora", "rhel", "redhat", "centos", "almalinux", "rocky", "ol"} {
+		RegisterPackageManager(id, NewDnfPackageManager)
+	}
+	for _, id := range []string{"opensuse", "opensuse-leap", "opensuse-tumbleweed", "suse", "sles"} {
+		RegisterPackageManager(id, NewZypperPackageManager)
+	}
+	for _, id := range []string{"arch", "manjaro", "endeavouros", "garuda"} {
+		RegisterPackageManager(id, NewPacmanPackageManager)
+	}
+}
+
+// NewPackageManager returns the package manager for the running distribution
+func NewPackageManager(source OSReleaseSource, ostreeBooted OSTreeCheck, runner, deferred CommandRunner) (PackageManager, error) {
+	osRelease, err := source()
+	if err != nil {
+		return nil, err
+	}
+
+	// Image based systems (Silverblue, Kinoite...) must layer packages with rpm-ostree
+	if ostreeBooted() {
+		return NewRPMOSTreePackageManager(runner, deferred), nil
+	}
+
+	return PackageManagerFor(osRelease, runner, deferred)
+}
+
+// PackageManagerFor looks up the package manager using the ID and, as a
+// fallback, each ID_LIKE entry of an os-release file
+func PackageManagerFor(osRelease map[string]string, runner, deferred CommandRunner) (PackageManager, error) {
+	ids := []string{osRelease["ID"]}
+	ids = append(ids, strings.Fields(osRelease["ID_LIKE"])...)
+
+	for _, id := range ids {
+		if factory, ok := packageManagers[id]; ok {
+			return factory(runner, deferred), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported OS: %s", osRelease["ID"])
+}
+
+// SystemOSRelease reads the os-release file of the running system
+func SystemOSRelease() (map[string]string, error) {
+	return ReadOSRelease(OSReleaseFile)
+}
+
+// ReadOSRelease parses an os-release file into a key/value map
+func ReadOSRelease(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s, reason: %v", path, err)
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		values[key] = strings.Trim(value, `"'`)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s, reason: %v", path, err)
+	}
+
+	return values, nil
+}
+
+// IsOSTreeBooted reports if the running system has been booted by OSTree
+func IsOSTreeBooted() bool {
+	_, err := os.Stat("/run/ostree-booted")
+	return err == nil
+}
+
+func runPackageCommand(runner CommandRunner, name string, arg ...string) error {
+	out, err := runner.Run(name, arg...)
+	if err != nil {
+		return fmt.Errorf("%s %s failed, reason: %v, output: %s", name, strings.Join(arg, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// queryRPMVersion returns the full version of an installed package like
+// dpkg-query does: [epoch:]version-release, the epoch only if it's set
+func queryRPMVersion(runner CommandRunner, pkg string) (string, error) {
+	out, err := runner.Run("rpm", "-q", "--qf", "%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}", pkg)
+	if err != nil {
+		return "", fmt.Errorf("package %s is not installed", pkg)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Apt manages packages on Debian based distributions
+type Apt struct {
+	runner   CommandRunner
+	deferred CommandRunner
+}
+
+func NewAptPackageManager(runner, deferred CommandRunner) PackageManager {
+	return &Apt{runner: runner, deferred: deferred}
+}
+
+func (p *Apt) Name() string {
+	return "apt"
+}
+
+func (p *Apt) Refresh() error {
+	return runPackageCommand(p.runner, "apt", "update")
+}
+
+func (p *Apt) ValidateVersion(version string) error {
+	return validateVersion(debianVersion, version)
+}
+
+func (p *Apt) Install(pkg, version string) error {
+	if err := p.ValidateVersion(version); err != nil {
+		return err
+	}
+	if version != "" {
+		pkg = pkg + "=" + version
+	}
+	return runPackageCommand(p.deferred, "apt", "install", "-y", "--allow-downgrades", pkg)
+}
+
+func (p *Apt) InstallFile(path string) error {
+	return runPackageCommand(p.deferred, "apt", "install", "-y", "--allow-downgrades", path)
+}
+
+func (p *Apt) PackageExtension() string {
+	return ".deb"
+}
+
+func (p *Apt) Remove(pkg string) error {
+	return runPackageCommand(p.deferred, "apt", "purge", "-y", pkg)
+}
+
+func (p *Apt) InstalledVersion(pkg string) (string, error) {
+	out, err := p.runner.Run("dpkg-query", "-W", "-f=${Version}", pkg)
+	if err != nil {
+		return "", fmt.Errorf("package %s is not installed", pkg)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Dnf manages packages on Fedora and Red Hat based distributions
+type Dnf struct {
+	runner   CommandRunner
+	deferred CommandRunner
+}
+
+func NewDnfPackageManager(runner, deferred CommandRunner) PackageManager {
+	return &Dnf{runner: runner, deferred: deferred}
+}
+
+func (p *Dnf) Name() string {
+	return "dnf"
+}
+
+func (p *Dnf) Refresh() error {
+	return runPackageCommand(p.runner, "dnf", "makecache", "--refresh")
+}
+
+func (p *Dnf) ValidateVersion(version string) error {
+	return validateVersion(rpmVersion, version)
+}
+
+func (p *Dnf) Install(pkg, version string) error {
+	if err := p.ValidateVersion(version); err != nil {
+		return err
+	}
+	if version != "" {
+		pkg = pkg + "-" + version
+	}
+	return runPackageCommand(p.deferred, "dnf", "install", "--allow-downgrade", "--refresh", "-y", pkg)
+}
+
+func (p *Dnf) InstallFile(path string) error {
+	return runPackageCommand(p.deferred, "dnf", "install", "--allow-downgrade", "-y", path)
+}
+
+func (p *Dnf) PackageExtension() string {
+	return ".rpm"
+}
+
+func (p *Dnf) Remove(pkg string) error {
+	return runPackageCommand(p.deferred, "dnf", "remove", "-y", pkg)
+}
+
+func (p *Dnf) InstalledVersion(pkg string) (string, error) {
+	return queryRPMVersion(p.runner, pkg)
+}
+
+// Zypper manages packages on openSUSE and SUSE Linux Enterprise
+type Zypper struct {
+	runner   CommandRunner
+	deferred CommandRunner
+}
+
+func NewZypperPackageManager(runner, deferred CommandRunner) PackageManager {
+	return &Zypper{runner: runner, deferred: deferred}
+}
+
+func (p *Zypper) Name() string {
+	return "zypper"
+}
+
+func (p *Zypper) Refresh() error {
+	return runPackageCommand(p.runner, "zypper", "--non-interactive", "refresh")
+}
+
+func (p *Zypper) ValidateVersion(version string) error {
+	return validateVersion(rpmVersion, version)
+}
+
+func (p *Zypper) Install(pkg, version string) error {
+	if err := p.ValidateVersion(version); err != nil {
+		return err
+	}
+	if version != "" {
+		pkg = pkg + "=" + version
+	}
+	return runPackageCommand(p.deferred, "zypper", "--non-interactive", "install", "--oldpackage", pkg)
+}
+
+func (p *Zypper) InstallFile(path string) error {
+	return runPackageCommand(p.deferred, "zypper", "--non-interactive", "install", "--oldpackage", path)
+}
+
+func (p *Zypper) PackageExtension() string {
+	return ".rpm"
+}
+
+func (p *Zypper) Remove(pkg string) error {
+	return runPackageCommand(p.deferred, "zypper", "--non-interactive", "remove", pkg)
+}
+
+func (p *Zypper) InstalledVersion(pkg string) (string, error) {
+	return queryRPMVersion(p.runner, pkg)
+}
+
+// PacmanCacheDir is where pacman keeps the packages it has downloaded
+const PacmanCacheDir = "/var/cache/pacman/pkg"
+
+// Pacman manages packages on Arch based distributions. The repositories only
+// offer their latest version, a pinned version is installed from the package
+// cache and Arch doesn't support syncing the repositories without upgrading
+type Pacman struct {
+	runner   CommandRunner
+	deferred CommandRunner
+	cacheDir string
+}
+
+func NewPacmanPackageManager(runner, deferred CommandRunner) PackageManager {
+	return &Pacman{runner: runner, deferred: deferred, cacheDir: PacmanCacheDir}
+}
+
+func (p *Pacman) Name() string {
+	return "pacman"
+}
+
+// Refresh does nothing, the repositories are synced by the full upgrade run
+// to install the latest version
+func (p *Pacman) Refresh() error {
+	return nil
+}
+
+func (p *Pacman) ValidateVersion(version string) error {
+	return validateVersion(pacmanVersion, version)
+}
+
+func (p *Pacman) Install(pkg, version string) error {
+	if err := p.ValidateVersion(version); err != nil {
+		return err
+	}
+	if version == "" {
+		return runPackageCommand(p.deferred, "pacman", "-Syu", "--noconfirm", "--needed", pkg)
+	}
+
+	path, err := p.cachedPackage(pkg, version)
+	if err != nil {
+		return err
+	}
+	return runPackageCommand(p.deferred, "pacman", "-U", "--noconfirm", path)
+}
+
+// cachedPackage finds the package file of a version in the package cache,
+// named <pkg>-<version>-<release>-<arch>.pkg.tar.<compression>. If the version
+// has no release the last cached release in name order is used
+func (p *Pacman) cachedPackage(pkg, version string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(p.cacheDir, pkg+"-"+version+"-*.pkg.tar.*"))
+	if err != nil {
+		return "", err
+	}
+
+	// What's left after the version is the architecture, and the release if the version hasn't got it
+	separators := 0
+	if !strings.Contains(version, "-") {
+		separators = 1
+	}
+
+	path := ""
+	for _, m := range matches {
+		rest, _, _ := strings.Cut(strings.TrimPrefix(filepath.Base(m), pkg+"-"+version+"-"), ".pkg.tar.")
+		if strings.HasSuffix(m, ".sig") || strings.Count(rest, "-") != separators {
+			continue
+		}
+		path = m
+	}
+
+	if path == "" {
+		return "", fmt.Errorf("pinned version not supported, pacman can only install %s %s from the package cache %s and it's not there", pkg, version, p.cacheDir)
+	}
+	return path, nil
+}
+
+func (p *Pacman) InstallFile(path string) error {
+	return runPackageCommand(p.deferred, "pacman", "-U", "--noconfirm", path)
+}
+
+func (p *Pacman) PackageExtension() string {
+	return ".pkg.tar.zst"
+}
+
+func (p *Pacman) Remove(pkg string) error {
+	return runPackageCommand(p.deferred, "pacman", "-Rns", "--noconfirm", pkg)
+}
+
+func (p *Pacman) InstalledVersion(pkg string) (string, error) {
+	out, err := p.runner.Run("pacman", "-Q", pkg)
+	if err != nil {
+		return "", fmt.Errorf("package %s is not installed", pkg)
+	}
+
+	// pacman -Q prints "name version"
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", fmt.Errorf("unexpected pacman output: %s", strings.TrimSpace(string(out)))
+	}
+	return fields[1], nil
+}
+
+// RPMOSTree layers packages on image based Fedora variants
+type RPMOSTree struct {
+	runner   CommandRunner
+	deferred CommandRunner
+}
+
+func NewRPMOSTreePackageManager(runner, deferred CommandRunner) PackageManager {
+	return &RPMOSTree{runner: runner, deferred: deferred}
+}
+
+func (p *RPMOSTree) Name() string {
+	return "rpm-ostree"
+}
+
+func (p *RPMOSTree) Refresh() error {
+	return runPackageCommand(p.runner, "rpm-ostree", "refresh-md")
+}
+
+func (p *RPMOSTree) ValidateVersion(version string) error {
+	return validateVersion(rpmVersion, version)
+}
+
+func (p *RPMOSTree) Install(pkg, version string) error {
+	if err := p.ValidateVersion(version); err != nil {
+		return err
+	}
+	if version == "" {
+		return runPackageCommand(p.deferred, "rpm-ostree", "install", "--idempotent", pkg)
+	}
+
+	// A layered package is replaced by the exact NEVRA in the same transaction
+	nevra := pkg + "-" + version
+	if _, err := p.InstalledVersion(pkg); err != nil {
+		return runPackageCommand(p.deferred, "rpm-ostree", "install", nevra)
+	}
+	return runPackageCommand(p.deferred, "rpm-ostree", "uninstall", pkg, "--install", nevra)
+}
+
+func (p *RPMOSTree) InstallFile(path string) error {
+	return runPackageCommand(p.deferred, "rpm-ostree", "install", path)
+}
+
+func (p *RPMOSTree) PackageExtension() string {
+	return ".rpm"
+}
+
+func (p *RPMOSTree) Remove(pkg string) error {
+	return runPackageCommand(p.deferred, "rpm-ostree", "uninstall", pkg)
+}
+
+func (p *RPMOSTree) InstalledVersion(pkg string) (string, error) {
+	return queryRPMVersion(p.runner, pkg)
+}
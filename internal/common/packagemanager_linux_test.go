@@ -0,0 +1,223 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// hostileVersions must be rejected by every grammar
+var hostileVersions = map[string]string{
+	"command separator":    "1.0;rm -rf /",
+	"command substitution": "$(id)",
+	"backticks":            "`id`",
+	"leading dash":         "-1.0",
+	"option":               "--force",
+	"newline":              "1.0\nrm -rf /",
+	"trailing newline":     "1.0\n",
+	"space":                "1.0 2.0",
+	"pipe":                 "1.0|id",
+	"redirection":          "1.0>/etc/passwd",
+	"over length":          "1." + strings.Repeat("0", maxVersionLength),
+}
+
+func TestValidateVersion(t *testing.T) {
+	grammars := []struct {
+		name    string
+		grammar *regexp.Regexp
+		valid   []string
+	}{
+		{"debian", debianVersion, []string{"", "1.0.0", "1:1.0.0-1", "1.0.0~rc1", "1.0.0+dfsg-2ubuntu1"}},
+		{"rpm", rpmVersion, []string{"", "1.0.0", "1:1.0.0-1.fc40", "1.0.0~rc1-1", "1.0.0^20240101-1"}},
+		{"pacman", pacmanVersion, []string{"", "1.0.0", "1:1.0.0-1", "1.0.0-1.1"}},
+	}
+
+	for _, g := range grammars {
+		for _, v := range g.valid {
+			if err := validateVersion(g.grammar, v); err != nil {
+				t.Errorf("%s: version %q should be valid: %v", g.name, v, err)
+			}
+		}
+
+		for name, v := range hostileVersions {
+			if err := validateVersion(g.grammar, v); err == nil {
+				t.Errorf("%s: %s version %q should be rejected", g.name, name, v)
+			}
+		}
+	}
+}
+
+func TestValidateVersionMaxLength(t *testing.T) {
+	version := "1." + strings.Repeat("0", maxVersionLength-2)
+	if err := validateVersion(debianVersion, version); err != nil {
+		t.Errorf("a version of %d characters should be valid: %v", len(version), err)
+	}
+}
+
+func TestInstallRejectsHostileVersions(t *testing.T) {
+	for id, factory := range map[string]PackageManagerFactory{
+		"apt":        NewAptPackageManager,
+		"dnf":        NewDnfPackageManager,
+		"zypper":     NewZypperPackageManager,
+		"pacman":     NewPacmanPackageManager,
+		"rpm-ostree": NewRPMOSTreePackageManager,
+	} {
+		for name, v := range hostileVersions {
+			runner := &RecordingCommandRunner{}
+			deferred := &RecordingCommandRunner{}
+			pm := factory(runner, deferred)
+
+			if err := pm.Install(AgentPackage, v); err == nil {
+				t.Errorf("%s: install with %s version %q should fail", id, name, v)
+			}
+			if commands := append(runner.Commands(), deferred.Commands()...); len(commands) > 0 {
+				t.Errorf("%s: install with %s version %q ran %q", id, name, v, commands)
+			}
+		}
+	}
+}
+
+func TestInstallCommands(t *testing.T) {
+	cache := t.TempDir()
+	for _, name := range []string{
+		"openuem-agent-1.2.3-1-x86_64.pkg.tar.zst",
+		"openuem-agent-1.2.3-1-x86_64.pkg.tar.zst.sig",
+		"openuem-agent-1.2.3-2-x86_64.pkg.tar.zst",
+		"openuem-agent-1.2.30-1-x86_64.pkg.tar.zst",
+	} {
+		if err := os.WriteFile(filepath.Join(cache, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layered := map[string]string{"rpm -q --qf %|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE} openuem-agent": "1.0.0-1"}
+	notLayered := map[string]error{"rpm -q --qf %|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE} openuem-agent": os.ErrNotExist}
+
+	tests := []struct {
+		factory PackageManagerFactory
+		outputs map[string]string
+		errors  map[string]error
+		version string
+		command string
+	}{
+		{NewAptPackageManager, nil, nil, "1.2.3-1", "apt install -y --allow-downgrades openuem-agent=1.2.3-1"},
+		{NewAptPackageManager, nil, nil, "", "apt install -y --allow-downgrades openuem-agent"},
+		{NewDnfPackageManager, nil, nil, "1.2.3-1", "dnf install --allow-downgrade --refresh -y openuem-agent-1.2.3-1"},
+		{NewZypperPackageManager, nil, nil, "1.2.3-1", "zypper --non-interactive install --oldpackage openuem-agent=1.2.3-1"},
+		{testPacman(cache), nil, nil, "1.2.3-1", "pacman -U --noconfirm " + filepath.Join(cache, "openuem-agent-1.2.3-1-x86_64.pkg.tar.zst")},
+		{testPacman(cache), nil, nil, "1.2.3", "pacman -U --noconfirm " + filepath.Join(cache, "openuem-agent-1.2.3-2-x86_64.pkg.tar.zst")},
+		{testPacman(cache), nil, nil, "", "pacman -Syu --noconfirm --needed openuem-agent"},
+		{NewRPMOSTreePackageManager, layered, nil, "1.2.3-1", "rpm-ostree uninstall openuem-agent --install openuem-agent-1.2.3-1"},
+		{NewRPMOSTreePackageManager, nil, notLayered, "1.2.3-1", "rpm-ostree install openuem-agent-1.2.3-1"},
+		{NewRPMOSTreePackageManager, nil, nil, "", "rpm-ostree install --idempotent openuem-agent"},
+	}
+
+	for _, tt := range tests {
+		runner := &RecordingCommandRunner{Outputs: tt.outputs, Errors: tt.errors}
+		deferred := &RecordingCommandRunner{}
+		pm := tt.factory(runner, deferred)
+
+		if err := pm.Install(AgentPackage, tt.version); err != nil {
+			t.Fatalf("%s: install failed: %v", pm.Name(), err)
+		}
+		if commands := deferred.Commands(); len(commands) != 1 || commands[0] != tt.command {
+			t.Errorf("%s: install ran %q, expected %q", pm.Name(), commands, tt.command)
+		}
+		if slices.ContainsFunc(runner.Commands(), func(c string) bool { return !strings.HasPrefix(c, "rpm -q") }) {
+			t.Errorf("%s: install ran %q immediately instead of deferring it", pm.Name(), runner.Commands())
+		}
+	}
+}
+
+// testPacman returns a pacman factory whose package cache is dir
+func testPacman(dir string) PackageManagerFactory {
+	return func(runner, deferred CommandRunner) PackageManager {
+		return &Pacman{runner: runner, deferred: deferred, cacheDir: dir}
+	}
+}
+
+func TestPacmanRejectsUncachedVersions(t *testing.T) {
+	deferred := &RecordingCommandRunner{}
+	pm := testPacman(t.TempDir())(&RecordingCommandRunner{}, deferred)
+
+	err := pm.Install(AgentPackage, "1.2.3-1")
+	if err == nil || !strings.Contains(err.Error(), "pinned version not supported") {
+		t.Errorf("installing a version that's not cached should fail, got %v", err)
+	}
+	if len(deferred.Commands()) > 0 {
+		t.Errorf("nothing should be installed, ran %q", deferred.Commands())
+	}
+}
+
+func TestPacmanRefreshDoesntSync(t *testing.T) {
+	runner := &RecordingCommandRunner{}
+	pm := NewPacmanPackageManager(runner, &RecordingCommandRunner{})
+
+	if err := pm.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.Commands()) > 0 {
+		t.Errorf("refresh ran %q, pacman mustn't sync without upgrading", runner.Commands())
+	}
+}
+
+func TestQueryRPMVersion(t *testing.T) {
+	runner := &RecordingCommandRunner{Outputs: map[string]string{
+		"rpm -q --qf %|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE} openuem-agent": "1.2.3-1.fc40\n",
+	}}
+
+	version, err := queryRPMVersion(runner, AgentPackage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.2.3-1.fc40" {
+		t.Errorf("got version %q", version)
+	}
+	if !VersionMatches(version, "1.2.3-1.fc40") || !VersionMatches(version, "1.2.3") {
+		t.Errorf("version %q should match the requested versions", version)
+	}
+}
+
+func TestNewPackageManager(t *testing.T) {
+	fedora := func() (map[string]string, error) {
+		return map[string]string{"ID": "fedora"}, nil
+	}
+
+	tests := []struct {
+		name   string
+		source OSReleaseSource
+		ostree bool
+		want   PackageManager
+	}{
+		{"dnf", fedora, false, &Dnf{}},
+		{"rpm-ostree", fedora, true, &RPMOSTree{}},
+		{"id like", func() (map[string]string, error) {
+			return map[string]string{"ID": "linuxmint", "ID_LIKE": "ubuntu debian"}, nil
+		}, false, &Apt{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, err := NewPackageManager(tt.source, func() bool { return tt.ostree }, &RecordingCommandRunner{}, &RecordingCommandRunner{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprintf("%T", pm), fmt.Sprintf("%T", tt.want); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+
+	unsupported := func() (map[string]string, error) {
+		return map[string]string{"ID": "plan9"}, nil
+	}
+	if _, err := NewPackageManager(unsupported, func() bool { return false }, &RecordingCommandRunner{}, &RecordingCommandRunner{}); err == nil {
+		t.Error("an unsupported OS should be rejected")
+	}
+}
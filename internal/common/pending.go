@@ -0,0 +1,128 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// PendingUpdateRequest is received on agent.update.cancel.<AgentId> and
+// agent.update.reschedule.<AgentId>. UpdateAt is only used to reschedule
+type PendingUpdateRequest struct {
+	RequestID string    `json:"request_id"`
+	UpdateAt  time.Time `json:"update_at,omitempty"`
+}
+
+// PendingUpdatesResponse is the reply to the pending updates requests
+type PendingUpdatesResponse struct {
+	Updates []ScheduledUpdate `json:"updates"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// CancelUpdate removes a scheduled update that hasn't started yet
+func (us *UpdaterService) CancelUpdate(requestID string) error {
+	us.pendingJobsMu.Lock()
+	defer us.pendingJobsMu.Unlock()
+
+	job, ok := us.PendingJobs[requestID]
+	if !ok {
+		return fmt.Errorf("there is no pending update with request id %s", requestID)
+	}
+
+	if err := us.TaskScheduler.RemoveJob(job.ID()); err != nil {
+		return fmt.Errorf("could not remove the update task, reason: %v", err)
+	}
+	delete(us.PendingJobs, requestID)
+
+	if err := us.UpdateQueue.Remove(requestID); err != nil {
+		return fmt.Errorf("could not remove the scheduled update, reason: %v", err)
+	}
+
+	return nil
+}
+
+// RescheduleUpdate moves a scheduled update that hasn't started yet
+func (us *UpdaterService) RescheduleUpdate(requestID string, updateAt time.Time) error {
+	if updateAt.IsZero() {
+		return errors.New("the new update time is required")
+	}
+
+	update, ok := us.UpdateQueue.Get(requestID)
+	if !ok {
+		return fmt.Errorf("there is no pending update with request id %s", requestID)
+	}
+
+	if err := us.CancelUpdate(requestID); err != nil {
+		return err
+	}
+
+	update.Request.UpdateAt = updateAt
+	update.Request.UpdateNow = false
+	if err := us.UpdateQueue.Add(update); err != nil {
+		return fmt.Errorf("could not store the scheduled update, reason: %v", err)
+	}
+
+	return us.scheduleQueuedUpdate(update)
+}
+
+func (us *UpdaterService) cancelUpdateHandler(msg *nats.Msg) {
+	data := PendingUpdateRequest{}
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		us.respondPendingUpdates(msg, fmt.Errorf("could not unmarshal cancel request, reason: %v", err))
+		return
+	}
+
+	if err := us.CancelUpdate(data.RequestID); err != nil {
+		slog.Error("could not cancel update", "request_id", data.RequestID, "subject", msg.Subject, "error", err)
+		us.respondPendingUpdates(msg, err)
+		return
+	}
+
+	slog.Info("update has been cancelled", "request_id", data.RequestID, "subject", msg.Subject)
+	us.PublishUpdateStatus(data.RequestID, UPDATE_PHASE_CANCELLED, nil, nil, "")
+	us.respondPendingUpdates(msg, nil)
+}
+
+func (us *UpdaterService) rescheduleUpdateHandler(msg *nats.Msg) {
+	data := PendingUpdateRequest{}
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		us.respondPendingUpdates(msg, fmt.Errorf("could not unmarshal reschedule request, reason: %v", err))
+		return
+	}
+
+	if err := us.RescheduleUpdate(data.RequestID, data.UpdateAt); err != nil {
+		slog.Error("could not reschedule update", "request_id", data.RequestID, "subject", msg.Subject, "error", err)
+		us.respondPendingUpdates(msg, err)
+		return
+	}
+
+	slog.Info("update has been rescheduled", "request_id", data.RequestID, "subject", msg.Subject, "update_at", data.UpdateAt)
+	us.PublishUpdateStatus(data.RequestID, UPDATE_PHASE_SCHEDULED, &data.UpdateAt, nil, "")
+	us.respondPendingUpdates(msg, nil)
+}
+
+func (us *UpdaterService) listUpdatesHandler(msg *nats.Msg) {
+	us.respondPendingUpdates(msg, nil)
+}
+
+// respondPendingUpdates replies with the updates still queued on this endpoint
+func (us *UpdaterService) respondPendingUpdates(msg *nats.Msg, err error) {
+	response := PendingUpdatesResponse{Updates: us.UpdateQueue.List()}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("could not marshal pending updates response", "error", err)
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		slog.Error("could not respond to pending updates request", "error", err)
+	}
+}
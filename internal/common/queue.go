@@ -0,0 +1,184 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	openuem_nats "github.com/open-uem/nats"
+)
+
+// ScheduledUpdate is an update request waiting for its scheduled time
+type ScheduledUpdate struct {
+	RequestID   string                            `json:"request_id"`
+	Request     openuem_nats.OpenUEMUpdateRequest `json:"request"`
+	Maintenance MaintenanceOverride               `json:"maintenance"`
+	ReceivedAt  time.Time                         `json:"received_at"`
+}
+
+// UpdateQueue keeps scheduled update requests in a JSON state file so they
+// survive updater restarts
+type UpdateQueue struct {
+	path    string
+	mu      sync.Mutex
+	updates map[string]ScheduledUpdate
+}
+
+// StateFile returns the path of a state file in the state directory
+func StateFile(name string) (string, error) {
+	stateDir, err := GetStateDir()
+	if err != nil {
+		return "", fmt.Errorf("could not get the state directory, reason: %v", err)
+	}
+	return filepath.Join(stateDir, name), nil
+}
+
+// LoadUpdateQueue reads the queue from path, an empty queue is returned if
+// the file doesn't exist yet
+func LoadUpdateQueue(path string) (*UpdateQueue, error) {
+	q := UpdateQueue{path: path, updates: map[string]ScheduledUpdate{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &q, nil
+		}
+		return &q, fmt.Errorf("could not read update queue, reason: %v", err)
+	}
+
+	updates := []ScheduledUpdate{}
+	if err := json.Unmarshal(data, &updates); err != nil {
+		return &q, fmt.Errorf("could not parse update queue, reason: %v", err)
+	}
+
+	for _, u := range updates {
+		q.updates[u.RequestID] = u
+	}
+
+	return &q, nil
+}
+
+// Add stores an update and returns once it has been written to disk
+func (q *UpdateQueue) Add(u ScheduledUpdate) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.updates[u.RequestID] = u
+	if err := q.save(); err != nil {
+		delete(q.updates, u.RequestID)
+		return err
+	}
+	return nil
+}
+
+// Remove deletes an update from the queue
+func (q *UpdateQueue) Remove(requestID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.updates[requestID]; !ok {
+		return nil
+	}
+
+	delete(q.updates, requestID)
+	return q.save()
+}
+
+// Get returns a queued update
+func (q *UpdateQueue) Get(requestID string) (ScheduledUpdate, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.updates[requestID]
+	return u, ok
+}
+
+// List returns the queued updates sorted by scheduled time
+func (q *UpdateQueue) List() []ScheduledUpdate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.list()
+}
+
+func (q *UpdateQueue) list() []ScheduledUpdate {
+	updates := []ScheduledUpdate{}
+	for _, u := range q.updates {
+		updates = append(updates, u)
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Request.UpdateAt.Before(updates[j].Request.UpdateAt)
+	})
+	return updates
+}
+
+func (q *UpdateQueue) save() error {
+	data, err := json.MarshalIndent(q.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteStateFile(q.path, data)
+}
+
+// WriteStateFile writes data to a temporary file and renames it so a crash
+// never leaves a truncated state file
+func WriteStateFile(path string, data []byte) error {
+	if path == "" {
+		return errors.New("the state directory is not known")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("could not create state directory, reason: %v", err)
+	}
+
+	return writeFileAtomic(path, data, 0600)
+}
+
+// writeFileAtomic replaces path with a temporary file holding data
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file, reason: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s, reason: %v", path, err)
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not set permissions of %s, reason: %v", path, err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync %s, reason: %v", path, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// RequestID identifies an update request using the message ID header set by
+// the publisher or, if missing, a hash of the payload
+func RequestID(msg jetstream.Msg) string {
+	if id := msg.Headers().Get(jetstream.MsgIDHeader); id != "" {
+		return id
+	}
+
+	sum := sha256.Sum256(msg.Data())
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"gopkg.in/ini.v1"
+)
+
+// RetryPolicy decides when a failed update request is delivered again. The
+// delay doubles with every delivery from BaseDelay up to MaxDelay and the
+// request is given up after MaxDeliveries
+type RetryPolicy struct {
+	MaxDeliveries int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+}
+
+// DeadLetter is published on agent.update.deadletter.<AgentId> when an update
+// request is given up, with the original payload so it can be inspected
+type DeadLetter struct {
+	AgentID      string    `json:"agent_id"`
+	RequestID    string    `json:"request_id"`
+	Subject      string    `json:"subject"`
+	Data         []byte    `json:"data"`
+	Error        string    `json:"error"`
+	NumDelivered uint64    `json:"num_delivered"`
+	Permanent    bool      `json:"permanent"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error that retrying won't fix, e.g a malformed request
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// IsPermanent reports if an error has been marked with Permanent
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// DefaultRetryPolicy is used for the settings missing in the INI file
+var DefaultRetryPolicy = RetryPolicy{
+	MaxDeliveries: 5,
+	BaseDelay:     5 * time.Minute,
+	MaxDelay:      60 * time.Minute,
+}
+
+// ReadRetryPolicy reads the retry settings from the Updater section of the
+// agent's INI file, e.g:
+//
+//	[Updater]
+//	UpdateMaxDeliveries = 5
+//	UpdateRetryDelayMinutes = 5
+//	UpdateMaxRetryDelayMinutes = 60
+func ReadRetryPolicy() RetryPolicy {
+	p := DefaultRetryPolicy
+
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return p
+	}
+
+	section := cfg.Section("Updater")
+	if v := section.Key("UpdateMaxDeliveries").MustInt(p.MaxDeliveries); v > 0 {
+		p.MaxDeliveries = v
+	}
+	if v := section.Key("UpdateRetryDelayMinutes").MustInt(int(p.BaseDelay.Minutes())); v > 0 {
+		p.BaseDelay = time.Duration(v) * time.Minute
+	}
+	if v := section.Key("UpdateMaxRetryDelayMinutes").MustInt(int(p.MaxDelay.Minutes())); v > 0 {
+		p.MaxDelay = time.Duration(v) * time.Minute
+	}
+	p.MaxDelay = max(p.MaxDelay, p.BaseDelay)
+
+	return p
+}
+
+// Delay returns the time to wait before the next delivery of a message that
+// has been delivered numDelivered times
+func (p RetryPolicy) Delay(numDelivered uint64) time.Duration {
+	delay := p.BaseDelay
+	for i := uint64(1); i < numDelivered && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// RetryMessage handles a failed update request: permanent errors and requests
+// that have been delivered too many times are terminated and sent to the dead
+// letter subject, the others are delivered again after a growing delay
+func (us *UpdaterService) RetryMessage(msg jetstream.Msg, requestID string, err error) {
+	if msg == nil {
+		return
+	}
+
+	policy := ReadRetryPolicy()
+
+	numDelivered := uint64(1)
+	if md, mdErr := msg.Metadata(); mdErr == nil {
+		numDelivered = md.NumDelivered
+	} else {
+		slog.Error("could not get message metadata", "request_id", requestID, "error", mdErr)
+	}
+
+	permanent := IsPermanent(err)
+	if !permanent && numDelivered < uint64(policy.MaxDeliveries) {
+		delay := policy.Delay(numDelivered)
+		slog.Info("the update request will be delivered again", "request_id", requestID, "num_delivered", numDelivered, "delay", delay.String())
+		NakMessage(msg, delay)
+		return
+	}
+
+	slog.Error("giving up the update request", "request_id", requestID, "num_delivered", numDelivered, "permanent", permanent, "error", err)
+	us.publishDeadLetter(msg, requestID, err, numDelivered, permanent)
+
+	if termErr := msg.TermWithReason(err.Error()); termErr != nil {
+		slog.Error("could not terminate message", "request_id", requestID, "error", termErr)
+	}
+}
+
+func (us *UpdaterService) publishDeadLetter(msg jetstream.Msg, requestID string, err error, numDelivered uint64, permanent bool) {
+	nc := us.connected()
+	if nc == nil {
+		slog.Error("could not publish the dead letter, not connected to NATS", "request_id", requestID)
+		return
+	}
+
+	data, marshalErr := json.Marshal(DeadLetter{
+		AgentID:      us.AgentId,
+		RequestID:    requestID,
+		Subject:      msg.Subject(),
+		Data:         msg.Data(),
+		Error:        err.Error(),
+		NumDelivered: numDelivered,
+		Permanent:    permanent,
+		Timestamp:    time.Now().UTC(),
+	})
+	if marshalErr != nil {
+		slog.Error("could not marshal the dead letter", "request_id", requestID, "error", marshalErr)
+		return
+	}
+
+	if pubErr := nc.Publish("agent.update.deadletter."+us.AgentId, data); pubErr != nil {
+		slog.Error("could not publish the dead letter", "request_id", requestID, "error", pubErr)
+	}
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// AgentServiceName is the name of the agent service in the service manager
+const AgentServiceName = "openuem-agent"
+
+// CommandRunner runs an external command and returns its combined output
+type CommandRunner interface {
+	Run(name string, arg ...string) ([]byte, error)
+}
+
+// ProcessRunner also starts commands the updater must not wait for, e.g an
+// installer that restarts the updater itself
+type ProcessRunner interface {
+	CommandRunner
+	Start(name string, arg ...string) error
+}
+
+// ExecCommandRunner runs commands on the local system using os/exec
+type ExecCommandRunner struct{}
+
+func (ExecCommandRunner) Run(name string, arg ...string) ([]byte, error) {
+	return exec.Command(name, arg...).CombinedOutput()
+}
+
+func (ExecCommandRunner) Start(name string, arg ...string) error {
+	return exec.Command(name, arg...).Start()
+}
+
+// DeferredJobResult is the outcome of a deferred command
+type DeferredJobResult struct {
+	ExitCode   int       `json:"exit_code"`
+	Output     string    `json:"output"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Err returns an error describing a failed command, nil if it succeeded
+func (r DeferredJobResult) Err() error {
+	if r.ExitCode == 0 {
+		return nil
+	}
+	return fmt.Errorf("command exited with code %d, output: %s", r.ExitCode, strings.TrimSpace(r.Output))
+}
+
+// DeferredRunner runs commands detached from the updater so they survive the
+// updater being restarted. Wait blocks until the last command has finished
+type DeferredRunner interface {
+	CommandRunner
+	Wait(timeout time.Duration) (DeferredJobResult, error)
+}
+
+// DeferredRunnerFactory creates the deferred runner of a package operation,
+// the unit names the operation so its result can be found later
+type DeferredRunnerFactory func(unit string) DeferredRunner
+
+// OSReleaseSource returns the os-release values used to pick the package manager
+type OSReleaseSource func() (map[string]string, error)
+
+// OSTreeCheck reports if the system is an image based one managed by rpm-ostree
+type OSTreeCheck func() bool
+
+// ServiceController starts, stops and queries the services of the system
+// service manager
+type ServiceController interface {
+	Start(service string) error
+	Stop(service string) error
+	Running(service string) bool
+}
+
+// RestartService stops the agent service and starts it again, its log is
+// rotated meanwhile if it's due
+func (us *UpdaterService) RestartService() error {
+	if err := us.Services.Stop(AgentServiceName); err != nil {
+		return err
+	}
+
+	us.rotateAgentLog()
+
+	return us.Services.Start(AgentServiceName)
+}
+
+// AgentServiceRunning reports if the agent service is running
+func (us *UpdaterService) AgentServiceRunning() bool {
+	return us.Services.Running(AgentServiceName)
+}
@@ -3,12 +3,11 @@ package common
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math"
-	"path/filepath"
-	"strconv"
-	"strings"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
@@ -21,112 +20,133 @@ import (
 
 type UpdaterService struct {
 	AgentId                string
-	NATSConnection         *nats.Conn
+	NATSConnection         *nats.Conn // guarded by connMu, read it with connection()
 	NATSConnectJob         gocron.Job
 	WatchdogJob            gocron.Job
-	NATSServers            string
+	LogRotationJob         gocron.Job
+	ConfigWatchJob         gocron.Job
+	ConfigRetryJob         gocron.Job
+	CertificateCheckJob    gocron.Job
 	TaskScheduler          gocron.Scheduler
 	Logger                 *openuem_utils.OpenUEMLogger
 	JetstreamContextCancel context.CancelFunc
-	AgentCert              string
-	AgentKey               string
-	CACert                 string
-	WebsocketPort          string
+	ConsumeContext         jetstream.ConsumeContext
+	ConsumerJob            gocron.Job
+	Subscriptions          []*nats.Subscription
+	UpdateQueue            *UpdateQueue
+	EventOutbox            *EventOutbox
+	PendingJobs            map[string]gocron.Job
+	RestartTracker         *RestartTracker
+	HealthConfig           *HealthConfig
+	LogRotator             *LogRotator
+	ConfigWatcher          *ConfigWatcher
+	CertificateMonitor     *CertificateMonitor
+	RequestLedger          *RequestLedger
+	Runner                 ProcessRunner
+	Services               ServiceController
+	DeferredRunners        DeferredRunnerFactory
+	OSRelease              OSReleaseSource
+	OSTreeBooted           OSTreeCheck
+	unhealthyResults       int
+	pendingJobsMu          sync.Mutex
+	connMu                 sync.Mutex
+	config                 atomic.Pointer[Config]
+	runningUpdates         map[string]time.Time
+	updatesWG              sync.WaitGroup
+	runningMu              sync.Mutex
+	stopping               bool
 }
 
 func (us *UpdaterService) StartService() {
 	// Start the task scheduler
 	us.TaskScheduler.Start()
-	log.Println("[INFO]: task scheduler has been started")
+	slog.Info("task scheduler has been started")
 
-	// Start NATS connection job
-	if err := us.StartNATSConnectJob(us.queueSubscribe); err != nil {
-		return
-	}
+	// Restore the events and updates that were pending when the updater stopped
+	us.LoadEventOutbox()
+	us.LoadRequestLedger()
+	us.LoadUpdateQueue()
 
 	// Start Watchdog job
 	if err := us.StartWatchdogJob(); err != nil {
-		return
+		slog.Error("could not start the watchdog", "error", err)
 	}
-}
 
-func (us *UpdaterService) StopService() {
-	if us.Logger != nil {
-		us.Logger.Close()
+	// Start log rotation job
+	if err := us.StartLogRotationJob(); err != nil {
+		slog.Error("could not start the log rotation", "error", err)
 	}
 
-	if us.NATSConnection != nil {
-		if err := us.NATSConnection.Flush(); err != nil {
-			log.Println("[ERROR]: could not flush NATS connection")
+	// Keep running with an invalid configuration, the watchdog doesn't need it
+	if err := us.ReadConfig(); err != nil {
+		slog.Error("the configuration is not valid", "error", err)
+		if err := us.StartConfigRetryJob(); err != nil {
+			slog.Error("could not retry reading the configuration", "error", err)
 		}
-		us.NATSConnection.Close()
-	}
-}
-
-func (us *UpdaterService) queueSubscribe() error {
-
-	// Create JetStream consumer with associated subjects
-	go func() {
-		us.CreateUpdaterJetStreamConsumer()
-	}()
-
-	// Subscribe to agent restart
-	_, err := us.NATSConnection.QueueSubscribe("agent.restart."+us.AgentId, "openuem-agent-management", us.restartHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to NATS message, reason: %v", err)
-		return err
+		return
 	}
-	log.Printf("[INFO]: subscribed to message agent.restart")
 
-	return nil
+	us.StartConnection()
 }
 
-func (us *UpdaterService) CreateUpdaterJetStreamConsumer() {
-	var ctx context.Context
+// StartConnection connects to NATS once the configuration has been read
+func (us *UpdaterService) StartConnection() {
+	// Every log line from now on belongs to this agent
+	slog.SetDefault(slog.Default().With("agent_id", us.AgentId))
 
-	js, err := jetstream.New(us.NATSConnection)
-	if err != nil {
-		log.Printf("[ERROR]: could not instantiate JetStream: %s", err.Error())
-		return
+	// Check the certificates before connecting
+	if err := us.StartCertificateCheckJob(); err != nil {
+		slog.Error("could not start the certificate check", "error", err)
+	} else {
+		us.CheckCertificates()
 	}
-	log.Println("[INFO]: JetStream has been instantiated")
 
-	ctx, us.JetstreamContextCancel = context.WithTimeout(context.Background(), 5*time.Minute)
-	s, err := js.Stream(ctx, "AGENTS_STREAM")
-	if err != nil {
-		log.Printf("[ERROR]: could not create stream AGENTS_STREAM: %v\n", err)
+	// Start NATS connection job
+	if err := us.StartNATSConnectJob(us.queueSubscribe); err != nil {
+		slog.Error("could not start the NATS connection", "error", err)
 		return
 	}
 
-	consumerConfig := jetstream.ConsumerConfig{
-		Durable:        "AgentUpdater" + us.AgentId,
-		FilterSubjects: []string{"agent.update." + us.AgentId, "agent.uninstall." + us.AgentId},
+	// Reload the configuration and the certificates when they change
+	if err := us.StartConfigWatchJob(); err != nil {
+		slog.Error("could not watch the configuration", "error", err)
 	}
+}
 
-	if len(strings.Split(us.NATSServers, ",")) > 1 {
-		consumerConfig.Replicas = int(math.Min(float64(len(strings.Split(us.NATSServers, ","))), 5))
-	}
+func (us *UpdaterService) StopService() {
+	us.Shutdown(readShutdownTimeout())
+}
 
-	c1, err := s.CreateOrUpdateConsumer(ctx, consumerConfig)
-	if err != nil {
-		log.Printf("[ERROR]: could not create Jetstream consumer: %s", err.Error())
-		return
-	}
-	// TODO stop consume context ()
-	_, err = c1.Consume(us.JetStreamUpdaterHandler, jetstream.ConsumeErrHandler(func(consumeCtx jetstream.ConsumeContext, err error) {
-		log.Printf("[ERROR]: consumer error: %s", err.Error())
-	}))
-	if err != nil {
-		log.Printf("[ERROR]: could not start consuming messages: %s", err.Error())
-		return
+func (us *UpdaterService) queueSubscribe() error {
+	subscriptions := []struct {
+		subject string
+		handler nats.MsgHandler
+	}{
+		{"agent.restart", us.restartHandler},
+		{"agent.update.cancel", us.cancelUpdateHandler},
+		{"agent.update.reschedule", us.rescheduleUpdateHandler},
+		{"agent.update.list", us.listUpdatesHandler},
+		{"agent.updater.status", us.statusHandler},
+	}
+
+	for _, s := range subscriptions {
+		if err := us.subscribe(s.subject+"."+us.AgentId, s.handler); err != nil {
+			slog.Error("could not subscribe to NATS message", "subject", s.subject, "error", err)
+			return err
+		}
+		slog.Info("subscribed to message", "subject", s.subject)
 	}
 
-	log.Println("[INFO]: Jetstream created and started consuming messages")
-	log.Println("[INFO]: subscribed to message", fmt.Sprintf("agent.update.%s", us.AgentId))
-	log.Println("[INFO]: subscribed to message", fmt.Sprintf("agent.uninstall.%s", us.AgentId))
+	// Publish the events stored while we were offline
+	us.FlushEventOutbox()
+
+	// Create JetStream consumer with associated subjects
+	return us.StartJetStreamConsumerJob()
 }
 
 func (us *UpdaterService) JetStreamUpdaterHandler(msg jetstream.Msg) {
+	slog.Debug("message received", "subject", msg.Subject())
+
 	if msg.Subject() == fmt.Sprintf("agent.update.%s", us.AgentId) {
 		us.updateHandler(msg)
 	}
@@ -137,31 +157,84 @@ func (us *UpdaterService) JetStreamUpdaterHandler(msg jetstream.Msg) {
 }
 
 func (us *UpdaterService) restartHandler(msg *nats.Msg) {
-	if err := RestartService(); err != nil {
+	if err := us.RestartService(); err != nil {
+		slog.Error("could not restart openuem-agent service", "error", err)
 		return
 	}
-	log.Println("[INFO]: agent has been forced to restart")
+	slog.Info("agent has been forced to restart", "subject", msg.Subject)
 
 	if err := msg.Respond(nil); err != nil {
-		log.Println("[ERROR]: could not respond to force restart request")
+		slog.Error("could not respond to force restart request", "error", err)
 	}
 }
 
 func (us *UpdaterService) updateHandler(msg jetstream.Msg) {
 	data := openuem_nats.OpenUEMUpdateRequest{}
+	requestID := RequestID(msg)
+	logger := slog.With("request_id", requestID, "subject", msg.Subject())
 
 	if err := json.Unmarshal(msg.Data(), &data); err != nil {
-		log.Printf("[ERROR]: could not unmarshal update request, reason: %v\n", err)
-		msg.NakWithDelay(60 * time.Minute)
-		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not unmarshal update request, reason: %v", err))
+		err = fmt.Errorf("could not unmarshal update request, reason: %v", err)
+		logger.Error("could not unmarshal update request", "error", err)
+		us.RetryMessage(msg, requestID, Permanent(err))
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, err.Error())
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
 		return
 	}
+	// A redelivered request must not be applied twice
+	if us.duplicateUpdate(requestID, msg) {
+		return
+	}
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_RECEIVED, nil, nil, "")
 
 	// If scheduled time is in the past execute now
 	if !time.Time.IsZero(data.UpdateAt) && data.UpdateAt.Before(time.Now().Local()) {
 		data.UpdateNow = true
 	}
 
+	// The request may replace the maintenance settings of the INI file
+	override, err := ReadMaintenanceOverride(msg.Data())
+	if err != nil {
+		err = Permanent(err)
+		logger.Error("could not read maintenance settings from request", "error", err)
+		us.RetryMessage(msg, requestID, err)
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, err.Error())
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
+		return
+	}
+
+	// Defer the update to the next maintenance window if it can't run now
+	if data.UpdateNow {
+		// A policy that can't be read doesn't allow any update until it's fixed
+		policy, err := RequestMaintenancePolicy(override)
+		if err != nil {
+			err = fmt.Errorf("could not read maintenance policy, reason: %v", err)
+			logger.Error("could not read maintenance policy, the update can't run", "error", err)
+			us.RetryMessage(msg, requestID, err)
+			SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, err.Error())
+			us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
+			return
+		}
+
+		now := time.Now().Local()
+		runAt := policy.NextRun(now)
+		if runAt.IsZero() {
+			err := Permanent(errors.New("the maintenance policy doesn't allow any update"))
+			logger.Error("the maintenance policy doesn't allow any update")
+			us.RetryMessage(msg, requestID, err)
+			SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, err.Error())
+			us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
+			return
+		}
+
+		if runAt.After(now) {
+			data.UpdateNow = false
+			data.UpdateAt = runAt
+			logger.Info("update deferred to the next maintenance window", "update_at", runAt)
+			SaveTaskInfoToINI(openuem_nats.UPDATE_PENDING, fmt.Sprintf("update deferred to the next maintenance window at %s", runAt.Format(time.RFC3339)))
+		}
+	}
+
 	if data.UpdateNow {
 		if _, err := us.TaskScheduler.NewJob(
 			gocron.OneTimeJob(
@@ -169,156 +242,288 @@ func (us *UpdaterService) updateHandler(msg jetstream.Msg) {
 			),
 			gocron.NewTask(
 				func() {
-					ExecuteUpdate(data, msg)
+					if !us.runUpdate(requestID, data, msg) {
+						NakMessage(msg, time.Minute)
+					}
 				},
 			),
+			gocron.WithName("update-"+requestID),
 		); err != nil {
-			log.Printf("[ERROR]: could not schedule the update task: %v\n", err)
-			msg.NakWithDelay(60 * time.Minute)
+			logger.Error("could not schedule the update task", "error", err)
+			us.RetryMessage(msg, requestID, err)
 			SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not schedule the update task: %v", err))
+			us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, fmt.Errorf("could not schedule the update task: %v", err), "")
 			return
 		}
-		log.Println("[INFO]: new update task will run now")
+		logger.Info("new update task will run now")
 	} else {
 		if !time.Time.IsZero(data.UpdateAt) {
-			if _, err := us.TaskScheduler.NewJob(
-				gocron.OneTimeJob(gocron.OneTimeJobStartDateTime(data.UpdateAt)),
-				gocron.NewTask(func() {
-					ExecuteUpdate(data, msg)
-				}),
-			); err != nil {
-				log.Printf("[ERROR]: could not schedule the update task: %v\n", err)
-				msg.NakWithDelay(60 * time.Minute)
+			// Persist the request before acking it so it's not lost if the updater restarts
+			update := ScheduledUpdate{RequestID: requestID, Request: data, Maintenance: override, ReceivedAt: time.Now()}
+			if err := us.UpdateQueue.Add(update); err != nil {
+				logger.Error("could not store the scheduled update", "error", err)
+				us.RetryMessage(msg, requestID, err)
+				SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not store the scheduled update, reason: %v", err))
+				us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, fmt.Errorf("could not store the scheduled update, reason: %v", err), "")
+				return
+			}
+
+			if err := us.scheduleQueuedUpdate(update); err != nil {
+				logger.Error("could not schedule the update task", "error", err)
+				if err := us.UpdateQueue.Remove(update.RequestID); err != nil {
+					logger.Error("could not remove the scheduled update", "error", err)
+				}
+				us.RetryMessage(msg, requestID, err)
 				SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not schedule the update task: %v", err))
+				us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, fmt.Errorf("could not schedule the update task: %v", err), "")
 				return
 			}
-			log.Printf("[INFO]: new update task scheduled at %s", data.UpdateAt.String())
+
+			us.recordRequest(requestID, data.Version, REQUEST_SCHEDULED)
+			AckMessage(msg)
+			us.PublishUpdateStatus(requestID, UPDATE_PHASE_SCHEDULED, &data.UpdateAt, nil, "")
+			logger.Info("new update task scheduled", "update_at", data.UpdateAt)
 		}
 	}
 }
 
-func (us *UpdaterService) uninstallHandler(msg jetstream.Msg) {
-	if err := UninstallAgent(); err != nil {
-		log.Printf("[ERROR]: could not run the uninstall agent, reason: %v\n", err)
+// LoadUpdateQueue reads the persisted update queue and schedules its updates again
+func (us *UpdaterService) LoadUpdateQueue() {
+	path, err := StateFile("scheduled-updates.json")
+	if err != nil {
+		slog.Error("the update queue can't be stored", "error", err)
 	}
 
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not ACK message, reason: %v", err)
-		return
+	us.UpdateQueue, err = LoadUpdateQueue(path)
+	if err != nil {
+		slog.Error("could not load the update queue", "error", err)
+	}
+
+	for _, update := range us.UpdateQueue.List() {
+		if err := us.scheduleQueuedUpdate(update); err != nil {
+			slog.Error("could not reschedule update", "request_id", update.RequestID, "error", err)
+			continue
+		}
+		slog.Info("update has been rescheduled", "request_id", update.RequestID, "update_at", update.Request.UpdateAt)
 	}
 }
 
-func SaveTaskInfoToINI(status, result string) {
+// scheduleQueuedUpdate creates the job for a persisted update. The message has
+// already been acked so the update runs without it
+func (us *UpdaterService) scheduleQueuedUpdate(update ScheduledUpdate) error {
+	// Updates that were due while the updater was stopped run now if the maintenance policy allows it
+	startAt := gocron.OneTimeJobStartDateTime(update.Request.UpdateAt)
+	if update.Request.UpdateAt.Before(time.Now()) {
+		startAt = gocron.OneTimeJobStartImmediately()
+	}
 
-	// Get conf file
-	configFile := openuem_utils.GetAgentConfigFile()
+	job, err := us.TaskScheduler.NewJob(
+		gocron.OneTimeJob(startAt),
+		gocron.NewTask(func() {
+			// Keep the update queued for the next run if we're stopping
+			if us.Stopping() {
+				return
+			}
 
-	// Open ini file
-	cfg, err := ini.Load(configFile)
+			// The policy may have changed since the update was scheduled or
+			// the scheduled time may fall outside the maintenance windows
+			if us.deferQueuedUpdate(update) {
+				return
+			}
+
+			// Dequeue before running so a restart during the install doesn't repeat it
+			us.pendingJobsMu.Lock()
+			if err := us.UpdateQueue.Remove(update.RequestID); err != nil {
+				slog.Error("could not remove the scheduled update", "error", err)
+			}
+			delete(us.PendingJobs, update.RequestID)
+			us.pendingJobsMu.Unlock()
+
+			us.runUpdate(update.RequestID, update.Request, nil)
+		}),
+		gocron.WithName("update-"+update.RequestID),
+	)
 	if err != nil {
-		log.Println("[ERROR]: could not load config file")
-		return
+		return err
 	}
 
-	cfg.Section("Agent").Key("UpdaterLastExecutionTime").SetValue(time.Now().Local().Format("2006-01-02T15:04:05"))
-	cfg.Section("Agent").Key("UpdaterLastExecutionStatus").SetValue(status)
-	cfg.Section("Agent").Key("UpdaterLastExecutionResult").SetValue(result)
-	if err := cfg.SaveTo(configFile); err != nil {
-		log.Println("[ERROR]: could not save update task info to INI file")
-		return
+	// Track the job so it can be cancelled or rescheduled, unless it has already started
+	us.pendingJobsMu.Lock()
+	defer us.pendingJobsMu.Unlock()
+	if _, ok := us.UpdateQueue.Get(update.RequestID); ok {
+		if us.PendingJobs == nil {
+			us.PendingJobs = map[string]gocron.Job{}
+		}
+		us.PendingJobs[update.RequestID] = job
 	}
+	return nil
 }
 
-func (us *UpdaterService) ReadConfig() error {
-	var err error
-
-	// Get conf file
-	configFile := openuem_utils.GetAgentConfigFile()
+// deferQueuedUpdate checks the maintenance policy when a scheduled update is
+// due, it reports true if the update has been moved to the next time the
+// policy allows or given up because the policy never allows it. If the policy
+// can't be read the update waits MaintenancePolicyRetryDelay
+func (us *UpdaterService) deferQueuedUpdate(update ScheduledUpdate) bool {
+	logger := slog.With("request_id", update.RequestID)
+	now := time.Now().Local()
 
-	// Open ini file
-	cfg, err := ini.Load(configFile)
+	policy, err := RequestMaintenancePolicy(update.Maintenance)
+	runAt := now.Add(MaintenancePolicyRetryDelay)
 	if err != nil {
-		return err
+		err = fmt.Errorf("could not read maintenance policy, reason: %v", err)
+		logger.Error("could not read maintenance policy, the update will wait", "error", err, "update_at", runAt)
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, err.Error())
+	} else {
+		runAt = policy.NextRun(now)
+		if runAt.Equal(now) {
+			return false
+		}
 	}
 
-	key, err := cfg.Section("Agent").GetKey("UUID")
-	if err != nil {
-		log.Println("[ERROR]: could not get UUID")
-		return err
+	if runAt.IsZero() {
+		err := errors.New("the maintenance policy doesn't allow any update")
+		logger.Error("the maintenance policy doesn't allow any update, the scheduled update is given up")
+
+		us.pendingJobsMu.Lock()
+		if err := us.UpdateQueue.Remove(update.RequestID); err != nil {
+			logger.Error("could not remove the scheduled update", "error", err)
+		}
+		delete(us.PendingJobs, update.RequestID)
+		us.pendingJobsMu.Unlock()
+
+		us.recordRequest(update.RequestID, update.Request.Version, REQUEST_FAILED)
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, err.Error())
+		us.PublishUpdateStatus(update.RequestID, UPDATE_PHASE_FAILED, nil, err, "")
+		return true
 	}
-	us.AgentId = key.String()
 
-	key, err = cfg.Section("NATS").GetKey("NATSServers")
-	if err != nil {
-		log.Println("[ERROR]: could not get NATSServers")
-		return err
+	update.Request.UpdateAt = runAt
+	if err := us.UpdateQueue.Add(update); err != nil {
+		logger.Error("could not store the scheduled update", "error", err)
+	}
+	if err := us.scheduleQueuedUpdate(update); err != nil {
+		logger.Error("could not schedule the update task", "error", err)
+		return true
 	}
-	us.NATSServers = key.String()
 
-	key, err = cfg.Section("NATS").GetKey("WebSocketPort")
-	if err == nil {
-		if _, err := strconv.Atoi(key.String()); err != nil {
-			log.Println("[ERROR]: the WebSocket port is not valid")
-			return err
-		}
-		us.WebsocketPort = key.String()
+	logger.Info("update deferred to the next maintenance window", "update_at", runAt)
+	us.PublishUpdateStatus(update.RequestID, UPDATE_PHASE_SCHEDULED, &runAt, nil, "")
+	return true
+}
+
+func (us *UpdaterService) uninstallHandler(msg jetstream.Msg) {
+	if err := us.UninstallAgent(); err != nil {
+		slog.Error("could not run the uninstall agent", "error", err)
 	}
 
-	// Read required certificates and private key either from config file or
-	// reading from the current directory
-	cwd, err := openuem_utils.GetWd()
-	if err != nil {
-		log.Fatalf("[FATAL]: could not get current working directory")
+	AckMessage(msg)
+}
+
+// AckMessage acknowledges a JetStream message. Updates restored from the
+// update queue run without a message
+func AckMessage(msg jetstream.Msg) {
+	if msg == nil {
+		return
 	}
 
-	// CA Cert
-	key, err = cfg.Section("Certificates").GetKey("CACert")
-	if err != nil {
-		log.Println("[ERROR]: could not get CA certificate from config file")
-		us.CACert = filepath.Join(cwd, "certificates", "ca.cer")
-	} else {
-		us.CACert = key.String()
+	if err := msg.Ack(); err != nil {
+		slog.Error("could not ACK message", "error", err)
 	}
+}
 
-	_, err = openuem_utils.ReadPEMCertificate(us.CACert)
-	if err != nil {
-		log.Fatalf("[FATAL]: could not read CA certificate")
+// NakMessage asks JetStream to redeliver a message after a delay
+func NakMessage(msg jetstream.Msg, delay time.Duration) {
+	if msg == nil {
+		return
 	}
 
-	// Agent cert
-	key, err = cfg.Section("Certificates").GetKey("AgentCert")
-	if err != nil {
-		log.Println("[ERROR]: could not get agent certificate from config file")
-		us.AgentCert = filepath.Join(cwd, "certificates", "agent.cer")
-	} else {
-		us.AgentCert = key.String()
+	if err := msg.NakWithDelay(delay); err != nil {
+		slog.Error("could not NAK message", "error", err)
 	}
+}
 
-	_, err = openuem_utils.ReadPEMCertificate(us.AgentCert)
+func SaveTaskInfoToINI(status, result string) {
+	err := UpdateINI(AgentConfigFile(), func(cfg *ini.File) bool {
+		cfg.Section("Agent").Key("UpdaterLastExecutionTime").SetValue(time.Now().Local().Format("2006-01-02T15:04:05"))
+		cfg.Section("Agent").Key("UpdaterLastExecutionStatus").SetValue(status)
+		cfg.Section("Agent").Key("UpdaterLastExecutionResult").SetValue(result)
+		return true
+	})
 	if err != nil {
-		log.Fatalf("[FATAL]: could not read agent certificate")
+		slog.Error("could not save update task info to INI file", "error", err)
 	}
+}
 
-	// Agent key
-	key, err = cfg.Section("Certificates").GetKey("AgentKey")
+// ReadConfig loads and validates the configuration, it's only applied if it's valid
+func (us *UpdaterService) ReadConfig() error {
+	config, warnings, err := Load(AgentConfigFile())
 	if err != nil {
-		log.Println("[ERROR]: could not get agent private key from config file")
-		us.AgentKey = filepath.Join(cwd, "certificates", "agent.cer")
-	} else {
-		us.AgentKey = key.String()
+		return err
+	}
+	for _, w := range warnings {
+		slog.Warn("the configuration has a problem", "warning", w)
 	}
 
-	_, err = openuem_utils.ReadPEMPrivateKey(us.AgentKey)
-	if err != nil {
-		log.Fatalf("[FATAL]: could not read agent private key")
+	us.SetConfig(config)
+	return nil
+}
+
+// Config returns the configuration in use, it's replaced as a whole when it's
+// reloaded so each reader must take it once
+func (us *UpdaterService) Config() Config {
+	if c := us.config.Load(); c != nil {
+		return *c
+	}
+	return Config{AgentID: us.AgentId}
+}
+
+// SetConfig applies a configuration returned by Load. The agent ID is only
+// set by the first one as the updater must be restarted to change it
+func (us *UpdaterService) SetConfig(c Config) {
+	if us.AgentId == "" {
+		us.AgentId = c.AgentID
 	}
+	us.config.Store(&c)
+}
+
+// StartConfigRetryJob reads the configuration every minute until it's valid
+// and then connects to NATS
+func (us *UpdaterService) StartConfigRetryJob() error {
+	var err error
+
+	us.ConfigRetryJob, err = us.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			time.Duration(1*time.Minute),
+		),
+		gocron.NewTask(func() {
+			if err := us.ReadConfig(); err != nil {
+				slog.Error("the configuration is still not valid", "error", err)
+				return
+			}
+			slog.Info("the configuration is now valid")
 
+			if err := us.TaskScheduler.RemoveJob(us.ConfigRetryJob.ID()); err != nil {
+				slog.Error("could not remove the config retry job", "error", err)
+			}
+
+			us.StartConnection()
+		}),
+		gocron.WithName("config-retry"),
+	)
+	if err != nil {
+		return fmt.Errorf("could not start the config retry job: %v", err)
+	}
+	slog.Info("new config retry job has been scheduled", "every_minutes", 1)
 	return nil
 }
 
 func (us *UpdaterService) StartWatchdogJob() error {
 	var err error
 
+	us.RestartTracker = NewRestartTracker()
+	us.HealthConfig = ReadHealthConfig()
+	us.LogRotator = NewLogRotator()
+
 	us.WatchdogJob, err = us.TaskScheduler.NewJob(
 		gocron.DurationJob(
 			time.Duration(time.Duration(5*time.Minute)),
@@ -326,10 +531,11 @@ func (us *UpdaterService) StartWatchdogJob() error {
 		gocron.NewTask(func() {
 			us.Watchdog()
 		}),
+		gocron.WithName("watchdog"),
 	)
 	if err != nil {
 		return fmt.Errorf("could not start the Watchdog job: %v", err)
 	}
-	log.Printf("[INFO]: new Watchdog job has been scheduled every %d minutes", 5)
+	slog.Info("new Watchdog job has been scheduled", "every_minutes", 5)
 	return nil
 }
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	openuem_nats "github.com/open-uem/nats"
+	"gopkg.in/ini.v1"
+)
+
+// ShutdownTimeout is how long StopService waits for the running updates and
+// the pending messages before closing everything. It can be set in the
+// Updater section of the agent's INI file with ShutdownTimeoutSeconds
+var ShutdownTimeout = 2 * time.Minute
+
+// readShutdownTimeout returns the shutdown deadline from the INI file or the default
+func readShutdownTimeout() time.Duration {
+	cfg, err := ini.Load(AgentConfigFile())
+	if err != nil {
+		return ShutdownTimeout
+	}
+	return time.Duration(cfg.Section("Updater").Key("ShutdownTimeoutSeconds").MustInt(int(ShutdownTimeout.Seconds()))) * time.Second
+}
+
+// runUpdate runs an update keeping track of it so the shutdown can wait for it.
+// Updates that would start while the updater is stopping are left for the next run
+func (us *UpdaterService) runUpdate(requestID string, data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) bool {
+	us.runningMu.Lock()
+	if us.stopping {
+		us.runningMu.Unlock()
+		return false
+	}
+	if us.runningUpdates == nil {
+		us.runningUpdates = map[string]time.Time{}
+	}
+	us.runningUpdates[requestID] = time.Now()
+	us.updatesWG.Add(1)
+	us.runningMu.Unlock()
+
+	defer func() {
+		us.runningMu.Lock()
+		delete(us.runningUpdates, requestID)
+		us.runningMu.Unlock()
+		us.updatesWG.Done()
+	}()
+
+	stop := keepInProgress(msg, requestID, UpdateHeartbeatInterval)
+	defer stop()
+
+	us.executeUpdate(requestID, data, msg)
+	return true
+}
+
+// Stopping reports if the updater is shutting down
+func (us *UpdaterService) Stopping() bool {
+	us.runningMu.Lock()
+	defer us.runningMu.Unlock()
+
+	return us.stopping
+}
+
+// stopAcceptingMessages stops consuming update requests and drains the core
+// subscriptions. The connection is kept open so the running updates can
+// still ack their messages and publish their status
+func (us *UpdaterService) stopAcceptingMessages() {
+	us.runningMu.Lock()
+	us.stopping = true
+	us.runningMu.Unlock()
+
+	us.connMu.Lock()
+	consumeContext := us.ConsumeContext
+	us.ConsumeContext = nil
+	subscriptions := us.Subscriptions
+	us.Subscriptions = nil
+	us.connMu.Unlock()
+
+	// Messages already fetched but not handled are redelivered later
+	if consumeContext != nil {
+		consumeContext.Stop()
+	}
+
+	for _, sub := range subscriptions {
+		if err := sub.Drain(); err != nil {
+			slog.Error("could not drain subscription", "subject", sub.Subject, "error", err)
+		}
+	}
+}
+
+// waitForUpdates waits until the running updates finish or the deadline is
+// reached, in which case the interrupted updates are recorded in the INI file
+func (us *UpdaterService) waitForUpdates(deadline time.Time) {
+	done := make(chan struct{})
+	go func() {
+		us.updatesWG.Wait()
+		close(done)
+	}()
+
+	us.runningMu.Lock()
+	running := len(us.runningUpdates)
+	us.runningMu.Unlock()
+	if running > 0 {
+		slog.Info("waiting for the running updates to finish", "updates", running)
+	}
+
+	select {
+	case <-done:
+		return
+	case <-time.After(time.Until(deadline)):
+	}
+
+	us.runningMu.Lock()
+	interrupted := slices.Sorted(maps.Keys(us.runningUpdates))
+	us.runningMu.Unlock()
+
+	for _, requestID := range interrupted {
+		slog.Error("the updater stopped before the update finished", "request_id", requestID)
+	}
+
+	// A message that hasn't been acked yet is redelivered by JetStream
+	SaveTaskInfoToINI(openuem_nats.UPDATE_PENDING, "the updater was stopped while the update was running, its result is unknown")
+}
+
+// Shutdown stops the updater in order before the deadline: it stops accepting
+// new messages, waits for the running updates, drains the NATS connection,
+// shuts down the task scheduler and closes the log
+func (us *UpdaterService) Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	slog.Info("the updater is stopping", "timeout", timeout.String())
+
+	us.stopAcceptingMessages()
+
+	us.waitForUpdates(deadline)
+
+	// Let the last events reach the server
+	us.closeConnection(max(time.Until(deadline), time.Second))
+
+	if us.ConfigWatcher != nil {
+		us.ConfigWatcher.Close()
+	}
+
+	if us.TaskScheduler != nil {
+		if err := us.TaskScheduler.Shutdown(); err != nil {
+			slog.Error("could not shut down the task scheduler", "error", err)
+		}
+	}
+
+	slog.Info("the updater has been stopped")
+
+	if us.Logger != nil {
+		us.Logger.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed keys
+var embeddedKeys embed.FS
+
+// signingKeys holds the package signing keys built into the updater in its
+// keys directory, see keys/README.md
+var signingKeys fs.FS = embeddedKeys
+
+// maxSignatureSize limits what we read when downloading a detached signature
+const maxSignatureSize = 4096
+
+// ReadSigningKey reads an Ed25519 public key in PEM format
+func ReadSigningKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key, reason: %v", err)
+	}
+
+	return ParseSigningKey(data)
+}
+
+// ParseSigningKey parses an Ed25519 public key in PEM format
+func ParseSigningKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not in PEM format")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key, reason: %v", err)
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("signing key is not an Ed25519 key")
+	}
+
+	return publicKey, nil
+}
+
+// TrustedSigningKeys returns the keys embedded in the updater followed by
+// the extra keys read from the given paths. A host can trust more keys but
+// it can't replace the embedded ones, without them nothing is trusted
+func TrustedSigningKeys(extraKeys []string) ([]ed25519.PublicKey, error) {
+	keys := []ed25519.PublicKey{}
+
+	entries, err := fs.ReadDir(signingKeys, "keys")
+	if err != nil {
+		return nil, fmt.Errorf("could not read embedded signing keys, reason: %v", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".pub" {
+			continue
+		}
+
+		data, err := fs.ReadFile(signingKeys, path.Join("keys", e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read embedded signing key %s, reason: %v", e.Name(), err)
+		}
+		key, err := ParseSigningKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("embedded signing key %s, %v", e.Name(), err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("there are no package signing keys embedded in the updater")
+	}
+
+	for _, p := range extraKeys {
+		key, err := ReadSigningKey(p)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// DownloadSignature gets a detached signature, either raw or base64 encoded
+func DownloadSignature(url string) ([]byte, error) {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download signature, status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, errors.New("invalid signature format")
+	}
+	return signature, nil
+}
+
+// VerifyFileSignature checks that the detached signature of a file has been
+// made with one of the trusted keys
+func VerifyFileSignature(path string, signature []byte, keys []ed25519.PublicKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, data, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature of %s is not valid", path)
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// newSigningKey creates an Ed25519 key pair and returns the public key in PEM format
+func newSigningKey(t *testing.T) ([]byte, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), private
+}
+
+// writeSigningKey creates an Ed25519 key pair and writes the public key in PEM format
+func writeSigningKey(t *testing.T, dir, name string) (string, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private := newSigningKey(t)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, public, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, private
+}
+
+// embedSigningKey replaces the keys built into the updater with a new one
+func embedSigningKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	public, private := newSigningKey(t)
+	keys := signingKeys
+	signingKeys = fstest.MapFS{
+		"keys/README.md": &fstest.MapFile{Data: []byte("# Package signing keys")},
+		"keys/test.pub":  &fstest.MapFile{Data: public},
+	}
+	t.Cleanup(func() { signingKeys = keys })
+
+	return private
+}
+
+func TestVerifyFileSignature(t *testing.T) {
+	embeddedPrivate := embedSigningKey(t)
+
+	dir := t.TempDir()
+	trusted, trustedPrivate := writeSigningKey(t, dir, "trusted.pub")
+	_, otherPrivate := writeSigningKey(t, dir, "other.pub")
+
+	file := filepath.Join(dir, "openuem-agent.deb")
+	data := []byte("package")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := TrustedSigningKeys([]string{trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyFileSignature(file, ed25519.Sign(embeddedPrivate, data), keys); err != nil {
+		t.Errorf("a package signed with the embedded key should be valid: %v", err)
+	}
+
+	if err := VerifyFileSignature(file, ed25519.Sign(trustedPrivate, data), keys); err != nil {
+		t.Errorf("a package signed with an extra key should be valid: %v", err)
+	}
+
+	if err := VerifyFileSignature(file, ed25519.Sign(otherPrivate, data), keys); err == nil {
+		t.Error("a package signed with an unknown key should be rejected")
+	}
+}
+
+func TestTrustedSigningKeys(t *testing.T) {
+	embedSigningKey(t)
+
+	if _, err := TrustedSigningKeys([]string{filepath.Join(t.TempDir(), "missing.pub")}); err == nil {
+		t.Error("a missing extra key should be an error")
+	}
+
+	notAKey := filepath.Join(t.TempDir(), "key.pub")
+	if err := os.WriteFile(notAKey, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TrustedSigningKeys([]string{notAKey}); err == nil {
+		t.Error("an extra key that isn't in PEM format should be an error")
+	}
+}
+
+func TestExtraKeysNeedEmbeddedKeys(t *testing.T) {
+	keys := signingKeys
+	signingKeys = fstest.MapFS{"keys/README.md": &fstest.MapFile{Data: []byte("# Package signing keys")}}
+	t.Cleanup(func() { signingKeys = keys })
+
+	extra, _ := writeSigningKey(t, t.TempDir(), "extra.pub")
+	if _, err := TrustedSigningKeys([]string{extra}); err == nil {
+		t.Error("the keys of the INI file mustn't be trusted on their own")
+	}
+}
+
+// TestEmbeddedSigningKeys checks the keys built into the updater against a
+// file signed by the release process, testdata/signed.txt and its detached
+// signature testdata/signed.txt.sig
+func TestEmbeddedSigningKeys(t *testing.T) {
+	if keys, _ := fs.Glob(embeddedKeys, "keys/*.pub"); len(keys) == 0 {
+		t.Skip("the OpenUEM package signing key is not in the keys directory")
+	}
+
+	keys, err := TrustedSigningKeys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) == 0 {
+		t.Fatal("no signing key is embedded in the updater")
+	}
+
+	signature, err := os.ReadFile(filepath.Join("testdata", "signed.txt.sig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFileSignature(filepath.Join("testdata", "signed.txt"), signature, keys); err != nil {
+		t.Errorf("the release signature should be valid: %v", err)
+	}
+}
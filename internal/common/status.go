@@ -0,0 +1,108 @@
+package common
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/ini.v1"
+)
+
+// Version is the updater version, set at build time with
+// -ldflags "-X github.com/open-uem/openuem-agent-updater/internal/common.Version=x.y.z"
+var Version = "dev"
+
+// UpdaterStatus is the reply to agent.updater.status.<AgentId> requests
+type UpdaterStatus struct {
+	AgentID             string              `json:"agent_id"`
+	UpdaterVersion      string              `json:"updater_version"`
+	Timestamp           time.Time           `json:"timestamp"`
+	AgentServiceRunning bool                `json:"agent_service_running"`
+	AgentCrashLooping   bool                `json:"agent_crash_looping"`
+	NATSStatus          string              `json:"nats_status"`
+	NATSServer          string              `json:"nats_server,omitempty"`
+	LastExecutionTime   string              `json:"last_execution_time,omitempty"`
+	LastExecutionStatus string              `json:"last_execution_status,omitempty"`
+	LastExecutionResult string              `json:"last_execution_result,omitempty"`
+	ScheduledJobs       []JobStatus         `json:"scheduled_jobs"`
+	PendingUpdates      []ScheduledUpdate   `json:"pending_updates"`
+	PendingEvents       int                 `json:"pending_events"`
+	Certificates        []CertificateStatus `json:"certificates"`
+}
+
+// JobStatus describes a job in the task scheduler
+type JobStatus struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	LastRun *time.Time `json:"last_run,omitempty"`
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+// Status collects what the updater is doing right now
+func (us *UpdaterService) Status() UpdaterStatus {
+	status := UpdaterStatus{
+		AgentID:             us.AgentId,
+		UpdaterVersion:      Version,
+		Timestamp:           time.Now().UTC(),
+		AgentServiceRunning: us.AgentServiceRunning(),
+		NATSStatus:          nats.DISCONNECTED.String(),
+		ScheduledJobs:       []JobStatus{},
+		PendingUpdates:      []ScheduledUpdate{},
+		Certificates:        []CertificateStatus{},
+	}
+
+	if nc := us.connection(); nc != nil {
+		status.NATSStatus = nc.Status().String()
+		status.NATSServer = nc.ConnectedUrlRedacted()
+	}
+
+	if cfg, err := ini.Load(AgentConfigFile()); err == nil {
+		status.LastExecutionTime = cfg.Section("Agent").Key("UpdaterLastExecutionTime").String()
+		status.LastExecutionStatus = cfg.Section("Agent").Key("UpdaterLastExecutionStatus").String()
+		status.LastExecutionResult = cfg.Section("Agent").Key("UpdaterLastExecutionResult").String()
+	}
+
+	if us.TaskScheduler != nil {
+		for _, job := range us.TaskScheduler.Jobs() {
+			js := JobStatus{ID: job.ID().String(), Name: job.Name()}
+			if lastRun, err := job.LastRun(); err == nil && !lastRun.IsZero() {
+				js.LastRun = &lastRun
+			}
+			if nextRun, err := job.NextRun(); err == nil && !nextRun.IsZero() {
+				js.NextRun = &nextRun
+			}
+			status.ScheduledJobs = append(status.ScheduledJobs, js)
+		}
+	}
+
+	if us.RestartTracker != nil {
+		status.AgentCrashLooping = us.RestartTracker.CrashLooping()
+	}
+
+	if us.UpdateQueue != nil {
+		status.PendingUpdates = us.UpdateQueue.List()
+	}
+
+	if us.EventOutbox != nil {
+		status.PendingEvents = us.EventOutbox.Len()
+	}
+
+	if us.CertificateMonitor != nil {
+		status.Certificates = us.CertificateMonitor.Statuses()
+	}
+
+	return status
+}
+
+func (us *UpdaterService) statusHandler(msg *nats.Msg) {
+	data, err := json.Marshal(us.Status())
+	if err != nil {
+		slog.Error("could not marshal updater status", "error", err)
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		slog.Error("could not respond to updater status request", "error", err)
+	}
+}
@@ -0,0 +1,157 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	openuem_nats "github.com/open-uem/nats"
+)
+
+var (
+	// InstallWindow is the time we wait for the deferred install to finish
+	InstallWindow = 10 * time.Minute
+	// ServiceGracePeriod is the time the agent service must stay active after the update
+	ServiceGracePeriod = 2 * time.Minute
+	// VerifyPollInterval is the time between checks while verifying an update
+	VerifyPollInterval = 15 * time.Second
+)
+
+// StagedPackageManager is implemented by package managers whose changes are
+// only applied after a reboot, so the installed version can't be verified
+type StagedPackageManager interface {
+	RequiresReboot() bool
+}
+
+func (p *RPMOSTree) RequiresReboot() bool {
+	return true
+}
+
+// VerifyUpdate waits for the deferred install to finish and checks that the
+// requested version is installed and the agent service keeps running. If
+// that's not the case the previous version is reinstalled
+func (us *UpdaterService) VerifyUpdate(requestID string, pm PackageManager, deferred DeferredRunner, version, previousVersion string) {
+	logger := slog.With("request_id", requestID)
+
+	if staged, ok := pm.(StagedPackageManager); ok && staged.RequiresReboot() {
+		logger.Info("the update is applied after a reboot, skipping verification", "package_manager", pm.Name())
+		SaveTaskInfoToINI(openuem_nats.UPDATE_SUCCESS, "")
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_SUCCEEDED, nil, nil, "")
+		return
+	}
+
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_VERIFYING, nil, nil, "")
+	err := waitForVersion(pm, version, InstallWindow)
+	if err == nil {
+		err = checkServiceStaysActive(us.Services, AgentServiceName, ServiceGracePeriod)
+	}
+
+	source, extraKeys := ReadPackageSource()
+
+	if err == nil {
+		logger.Info("the agent has been updated", "version", version)
+		if source == PACKAGE_SOURCE_DOWNLOAD {
+			// The installed package is kept as the rollback of the next update
+			PruneAgentPackages(pm.PackageExtension(), version)
+		}
+		SaveTaskInfoToINI(openuem_nats.UPDATE_SUCCESS, "")
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_SUCCEEDED, nil, nil, version)
+		return
+	}
+
+	logger.Error("the update could not be verified", "version", version, "error", err)
+
+	if previousVersion == "" {
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("update could not be verified and no previous version to roll back to, reason: %v", err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
+		return
+	}
+
+	if rollbackErr := RollbackUpdate(pm, deferred, us.Services, previousVersion, source, extraKeys); rollbackErr != nil {
+		logger.Error("could not roll back", "version", previousVersion, "error", rollbackErr)
+		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("update could not be verified and rollback to %s failed, reason: %v", previousVersion, rollbackErr))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, fmt.Errorf("%v, rollback failed: %v", err, rollbackErr), "")
+		return
+	}
+
+	logger.Info("the agent has been rolled back", "version", previousVersion)
+	// The agent and the console only know the shared statuses, the rollback is told in the result
+	SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("[ROLLBACK]: update could not be verified, rolled back to %s, reason: %v", previousVersion, err))
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_ROLLED_BACK, nil, err, previousVersion)
+}
+
+// RollbackUpdate reinstalls the previous agent version and waits until it's in
+// place. In download mode the package kept from the previous update is used as
+// the repositories may not be reachable
+func RollbackUpdate(pm PackageManager, deferred DeferredRunner, services ServiceController, previousVersion, source string, extraKeys []string) error {
+	if source == PACKAGE_SOURCE_DOWNLOAD {
+		packagePath, err := LocalAgentPackage(previousVersion, pm.PackageExtension(), extraKeys)
+		if err != nil {
+			return err
+		}
+		if err := pm.InstallFile(packagePath); err != nil {
+			return err
+		}
+	} else if err := pm.Install(AgentPackage, previousVersion); err != nil {
+		return err
+	}
+
+	result, err := deferred.Wait(InstallWindow)
+	if err != nil {
+		return err
+	}
+	if err := result.Err(); err != nil {
+		return err
+	}
+
+	if err := waitForVersion(pm, previousVersion, InstallWindow); err != nil {
+		return err
+	}
+
+	if !services.Running(AgentServiceName) {
+		if err := services.Start(AgentServiceName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func waitForVersion(pm PackageManager, version string, timeout time.Duration) error {
+	var installed string
+	var err error
+
+	deadline := time.Now().Add(timeout)
+	for {
+		installed, err = pm.InstalledVersion(AgentPackage)
+		if err == nil && VersionMatches(installed, version) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(VerifyPollInterval)
+	}
+
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("installed version is %s, expected %s", installed, version)
+}
+
+func checkServiceStaysActive(services ServiceController, service string, period time.Duration) error {
+	deadline := time.Now().Add(period)
+	for {
+		if !services.Running(service) {
+			return fmt.Errorf("the %s service is not active", service)
+		}
+
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(VerifyPollInterval)
+	}
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package common
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// newWatchdogTest returns an updater whose agent has the given INI file and
+// log, and whose services are running if the agent is
+func newWatchdogTest(t *testing.T, iniData string, running bool) (*UpdaterService, *FakeServiceController, string) {
+	t.Helper()
+
+	path := withAgentConfig(t, "[Agent]\nUUID = "+testAgentID+"\n"+iniData)
+	withAgentLog(t, time.Now())
+
+	services := NewFakeServiceController()
+	if running {
+		services = NewFakeServiceController(AgentServiceName)
+	}
+
+	us := UpdaterService{
+		AgentId:        testAgentID,
+		Services:       services,
+		LogRotator:     &LogRotator{MaxSize: 1024 * 1024, MaxAge: 24 * time.Hour, Generations: 2},
+		RestartTracker: &RestartTracker{MaxRestarts: 2, Window: 30 * time.Minute, BaseBackoff: 5 * time.Minute, MaxBackoff: time.Hour, MaxAttempts: 10},
+		HealthConfig:   &HealthConfig{HeartbeatMaxAge: 15 * time.Minute, UnhealthyChecks: 1},
+	}
+	return &us, services, path
+}
+
+func countActions(actions []string, action string) int {
+	n := 0
+	for _, a := range actions {
+		if a == action {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWatchdogRestartsWhenRequired(t *testing.T) {
+	us, services, path := newWatchdogTest(t, "RestartRequired = true\n", true)
+
+	us.Watchdog()
+
+	if actions := services.Actions(); !slices.Equal(actions, []string{"stop " + AgentServiceName, "start " + AgentServiceName}) {
+		t.Errorf("the service actions are %q", actions)
+	}
+
+	cfg, err := ini.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restartRequired := cfg.Section("Agent").Key("RestartRequired").MustBool(true); restartRequired {
+		t.Error("RestartRequired should be reset once the agent has been restarted")
+	}
+}
+
+func TestWatchdogStartsStoppedAgent(t *testing.T) {
+	us, services, path := newWatchdogTest(t, "RestartRequired = false\n", false)
+
+	// The agent crashes every time it's started
+	for range 3 {
+		us.Watchdog()
+		if err := services.Stop(AgentServiceName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if starts := countActions(services.Actions(), "start "+AgentServiceName); starts != 2 {
+		t.Errorf("the watchdog should back off after 2 restarts, it started the agent %d times", starts)
+	}
+	if !us.RestartTracker.CrashLooping() {
+		t.Error("the agent should be crash looping")
+	}
+
+	cfg, err := ini.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crashLooping := cfg.Section("Agent").Key("CrashLooping").MustBool(false); !crashLooping {
+		t.Error("the crash loop should be saved in the INI file")
+	}
+}
+
+func TestWatchdogChecksRunningAgentHealth(t *testing.T) {
+	us, services, _ := newWatchdogTest(t, "RestartRequired = false\n"+heartbeat(time.Now().Add(-time.Hour)), true)
+
+	us.Watchdog()
+
+	if actions := services.Actions(); !slices.Equal(actions, []string{"stop " + AgentServiceName, "start " + AgentServiceName}) {
+		t.Errorf("the unhealthy agent should be restarted, the service actions are %q", actions)
+	}
+}
+
+func TestWatchdogLeavesHealthyAgent(t *testing.T) {
+	us, services, _ := newWatchdogTest(t, "RestartRequired = false\n"+heartbeat(time.Now()), true)
+
+	us.Watchdog()
+
+	if actions := services.Actions(); len(actions) > 0 {
+		t.Errorf("the healthy agent shouldn't be touched, the service actions are %q", actions)
+	}
+}
@@ -4,105 +4,97 @@ package common
 
 import (
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
-	"time"
+	"log/slog"
+	"strings"
 
-	openuem_utils "github.com/open-uem/utils"
 	"gopkg.in/ini.v1"
 )
 
+var AgentLogFile = "/var/log/openuem-agent/openuem-agent.log"
+
 func (us *UpdaterService) Watchdog() {
 	var err error
 	var restartRequired bool
 
 	// Get conf file
-	configFile := openuem_utils.GetAgentConfigFile()
+	configFile := AgentConfigFile()
 
 	// Open ini file
 	cfg, err := ini.Load(configFile)
 	if err != nil {
-		log.Println("[ERROR]: could not load config file")
+		slog.Error("could not load config file", "error", err)
 		return
 	}
 
 	key, err := cfg.Section("Agent").GetKey("RestartRequired")
 	if err != nil {
-		log.Println("[ERROR]: could not get RestartRequired key")
+		slog.Error("could not get RestartRequired key", "error", err)
 	}
 
 	restartRequired, err = key.Bool()
 	if err != nil {
-		log.Println("[ERROR]: could not parse RestartRequired")
+		slog.Error("could not parse RestartRequired", "error", err)
 		return
 	}
 
 	// Check if service is running
 	if restartRequired {
 		// Restart service
-		if err := RestartService(); err != nil {
+		if err := us.RestartService(); err != nil {
+			slog.Error("could not restart openuem-agent service", "error", err)
 			return
 		}
 
-		cfg.Section("Agent").Key("RestartRequired").SetValue("false")
-		if err := cfg.SaveTo(configFile); err != nil {
-			log.Printf("[ERROR]: could not save RestartRequired to INI")
+		if err := resetRestartRequired(); err != nil {
+			slog.Error("could not save RestartRequired to INI", "error", err)
 		}
-		log.Printf("[INFO]: the agent has been restarted due to watchdog")
+		slog.Info("the agent has been restarted due to watchdog")
 	} else {
-		if !IsAgentServiceRunning() {
+		if !us.AgentServiceRunning() {
+			// Back off if the agent keeps crashing
+			if !us.canStartAgent() {
+				return
+			}
+
 			// Create a backup of the agent's log before starting the service
-			if err := os.Rename("/var/log/openuem-agent/openuem-agent.log", fmt.Sprintf("/var/log/openuem-agent/openuem-agent.%d.log", time.Now().Unix())); err != nil {
-				log.Printf("[ERROR]: could not create a backup of the agent log")
+			if err := us.LogRotator.Rotate(AgentLogFile, false); err != nil {
+				slog.Error("could not create a backup of the agent log", "error", err)
 			}
 
 			// Start service
-			if err := MacStartAgentService(); err != nil {
-				log.Printf("[ERROR]: could not start openuem-agent service, reason: %v\n", err)
+			us.agentStarted()
+			if err := us.Services.Start(AgentServiceName); err != nil {
+				slog.Error("could not start openuem-agent service", "error", err)
 				return
 			}
-			log.Printf("[INFO]: the agent service was started as it wasn't running (fatal error?)")
+			slog.Info("the agent service was started as it wasn't running (fatal error?)")
+		} else {
+			us.agentRunning()
+			us.CheckAgentHealth()
 		}
 	}
 }
 
-func RestartService() error {
-	// Stop service
-	if err := MacStopAgentService(); err != nil {
-		return err
-	}
-
-	// Start service
-	if err := MacStartAgentService(); err != nil {
-		return err
-	}
-
-	return nil
+// LaunchdServiceController manages the OpenUEM launch daemons with launchctl
+type LaunchdServiceController struct {
+	Runner CommandRunner
 }
 
-func MacStartAgentService() error {
-	if err := exec.Command("launchctl", "load", "-w", "/Library/LaunchDaemons/openuem-agent.plist").Run(); err != nil {
-		log.Printf("[ERROR]: could not start openuem-agent service, reason: %v\n", err)
-		return err
+func (c LaunchdServiceController) Start(service string) error {
+	if out, err := c.Runner.Run("launchctl", "load", "-w", "/Library/LaunchDaemons/"+service+".plist"); err != nil {
+		return fmt.Errorf("could not start %s service, reason: %v, output: %s", service, err, strings.TrimSpace(string(out)))
 	}
 	return nil
 }
 
-func MacStopAgentService() error {
-	if err := exec.Command("launchctl", "unload", "-w", "/Library/LaunchDaemons/openuem-agent.plist").Run(); err != nil {
-		log.Printf("[ERROR]: could not stop openuem-agent service, reason: %v\n", err)
-		return err
+func (c LaunchdServiceController) Stop(service string) error {
+	if out, err := c.Runner.Run("launchctl", "unload", "-w", "/Library/LaunchDaemons/"+service+".plist"); err != nil {
+		return fmt.Errorf("could not stop %s service, reason: %v, output: %s", service, err, strings.TrimSpace(string(out)))
 	}
-
 	return nil
 }
 
-func IsAgentServiceRunning() bool {
-	_, err := exec.Command("launchctl", "list", "eu.openuem.openuem-agent").Output()
-	if err != nil {
-		return false
-	}
-
-	return true
+func (c LaunchdServiceController) Running(service string) bool {
+	_, err := c.Runner.Run("launchctl", "list", "eu.openuem."+service)
+	return err == nil
 }
@@ -3,8 +3,7 @@
 package common
 
 import (
-	"log"
-	"os"
+	"log/slog"
 
 	openuem_utils "github.com/open-uem/utils"
 	"golang.org/x/sys/windows/svc"
@@ -12,92 +11,112 @@ import (
 	"gopkg.in/ini.v1"
 )
 
+var AgentLogFile = "C:\\Program Files\\OpenUEM Agent\\logs\\openuem-log.txt"
+
 func (us *UpdaterService) Watchdog() {
 	var err error
 	var restartRequired bool
 
 	// Get conf file
-	configFile := openuem_utils.GetAgentConfigFile()
+	configFile := AgentConfigFile()
 
 	// Open ini file
 	cfg, err := ini.Load(configFile)
 	if err != nil {
-		log.Println("[ERROR]: could not load config file")
+		slog.Error("could not load config file", "error", err)
 		return
 	}
 
 	key, err := cfg.Section("Agent").GetKey("RestartRequired")
 	if err != nil {
-		log.Println("[ERROR]: could not get RestartRequired key")
+		slog.Error("could not get RestartRequired key", "error", err)
 	}
 
 	restartRequired, err = key.Bool()
 	if err != nil {
-		log.Println("[ERROR]: could not parse RestartRequired")
+		slog.Error("could not parse RestartRequired", "error", err)
 		return
 	}
 
 	// Check if service is running
-	if restartRequired || !IsAgentServiceRunning() {
-		if IsAgentServiceRunning() {
+	running := us.AgentServiceRunning()
+	if restartRequired || !running {
+		// Back off if the agent keeps crashing
+		if !restartRequired && !us.canStartAgent() {
+			return
+		}
+
+		if running {
 			// Stop service
-			if err := openuem_utils.WindowsSvcControl("openuem-agent", svc.Stop, svc.Stopped); err != nil {
-				log.Printf("[ERROR]: could not stop openuem-agent service, reason: %v\n", err)
+			if err := us.Services.Stop(AgentServiceName); err != nil {
+				slog.Error("could not stop openuem-agent service", "error", err)
 			}
 		}
 
 		// Create a backup of the agent's log before starting the service
-		if err := os.Rename("C:\\Program Files\\OpenUEM Agent\\logs\\openuem-log.txt", "C:\\Program Files\\OpenUEM Agent\\logs\\openuem-log-before-forced-restart.txt"); err != nil {
-			log.Printf("[ERROR]: could not create a backup of the agent log")
+		if err := us.LogRotator.Rotate(AgentLogFile, false); err != nil {
+			slog.Error("could not create a backup of the agent log", "error", err)
 		}
 
 		// Start service
-		if err := openuem_utils.WindowsStartService("openuem-agent"); err != nil {
+		if !restartRequired {
+			us.agentStarted()
+		}
+		if err := us.Services.Start(AgentServiceName); err != nil {
 			// TODO: communicate this situation to the agent worker so it can show a warning
-			log.Printf("[ERROR]: could not start openuem-agent service, reason: %v\n", err)
+			slog.Error("could not start openuem-agent service", "error", err)
 			return
 		}
 
 		// Reset the flag if needed and inform
 		if restartRequired {
-			cfg.Section("Agent").Key("RestartRequired").SetValue("false")
-			if err := cfg.SaveTo(configFile); err != nil {
-				log.Printf("[ERROR]: could not save RestartRequired to INI")
+			if err := resetRestartRequired(); err != nil {
+				slog.Error("could not save RestartRequired to INI", "error", err)
 			}
-			log.Printf("[INFO]: the agent has been restarted due to watchdog")
+			slog.Info("the agent has been restarted due to watchdog")
 		} else {
-			log.Printf("[INFO]: the agent service was started as it wasn't running (fatal error?)")
+			slog.Info("the agent service was started as it wasn't running (fatal error?)")
 		}
+	} else {
+		us.agentRunning()
+		us.CheckAgentHealth()
 	}
 }
 
-func RestartService() error {
+// WindowsServiceController manages services with the Windows service manager
+type WindowsServiceController struct{}
 
-	// Start service
-	if err := openuem_utils.WindowsStartService("openuem-agent"); err != nil {
-		// TODO: communicate this situation to the agent worker so it can show a warning
-		log.Printf("[ERROR]: could not start openuem-agent service, reason: %v\n", err)
-		return err
-	}
+func (WindowsServiceController) Start(service string) error {
+	return openuem_utils.WindowsStartService(service)
+}
 
-	return nil
+// Stop stops the service if it's running
+func (c WindowsServiceController) Stop(service string) error {
+	if !c.Running(service) {
+		return nil
+	}
+	return openuem_utils.WindowsSvcControl(service, svc.Stop, svc.Stopped)
 }
 
-func IsAgentServiceRunning() bool {
+func (WindowsServiceController) Running(service string) bool {
 	m, err := mgr.Connect()
 	if err != nil {
-		log.Println("[ERROR]: could not connect with service manager")
+		slog.Error("could not connect with service manager", "error", err)
 		return false
 	}
 	defer m.Disconnect()
-	s, err := m.OpenService("openuem-agent")
+
+	s, err := m.OpenService(service)
 	if err != nil {
-		log.Println("[ERROR]: could not open openuem-agent service")
+		slog.Error("could not open service", "service", service, "error", err)
+		return false
 	}
+	defer s.Close()
 
 	status, err := s.Query()
 	if err != nil {
-		log.Println("[ERROR]: could not get openuem-agent service status")
+		slog.Error("could not get service status", "service", service, "error", err)
+		return false
 	}
 
 	return svc.Running == status.State
@@ -3,23 +3,25 @@
 package common
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"os/exec"
+	"log/slog"
+	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go/jetstream"
 	openuem_nats "github.com/open-uem/nats"
 	openuem_utils "github.com/open-uem/utils"
-	"golang.org/x/sys/windows/svc"
 )
 
 func NewUpdateService() (*UpdaterService, error) {
 	var err error
-	us := UpdaterService{}
-	us.Logger = openuem_utils.NewLogger("openuem-agent-updater.txt")
+	us := UpdaterService{
+		Runner:   ExecCommandRunner{},
+		Services: WindowsServiceController{},
+	}
+	us.Logger = NewLogger("openuem-agent-updater.txt")
 
 	us.TaskScheduler, err = gocron.NewScheduler()
 	if err != nil {
@@ -29,52 +31,82 @@ func NewUpdateService() (*UpdaterService, error) {
 	return &us, nil
 }
 
-func ExecuteUpdate(data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) {
+func (us *UpdaterService) ExecuteUpdate(requestID string, data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg) {
+	logger := slog.With("request_id", requestID)
+
 	// Download the file
 	cwd, err := openuem_utils.GetWd()
 	if err != nil {
-		log.Printf("[ERROR]: could not get working directory, reason %v", err)
-		msg.NakWithDelay(60 * time.Minute)
+		logger.Error("could not get working directory", "error", err)
+		us.RetryMessage(msg, requestID, err)
 		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not get working directory, reason %v", err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
 		return
 	}
 
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_DOWNLOADING, nil, nil, "")
+
 	// TODO - find a better place to save the agent installer and manage certificate location
 	downloadPath := filepath.Join(cwd, "updates", "agent-setup.exe")
 	if err := openuem_utils.DownloadFile(data.DownloadFrom, downloadPath, data.DownloadHash); err != nil {
-		log.Printf("[ERROR]: could not download update to directory, reason %v", err)
-		msg.NakWithDelay(60 * time.Minute)
+		logger.Error("could not download update to directory", "error", err)
+		us.RetryMessage(msg, requestID, err)
 		SaveTaskInfoToINI(openuem_nats.UPDATE_ERROR, fmt.Sprintf("could not download update to directory, reason %v\n", err))
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
 		return
 	}
 
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_RESTARTING, nil, nil, "")
+
 	// Stop service
-	if err := openuem_utils.WindowsSvcControl("openuem-agent", svc.Stop, svc.Stopped); err != nil {
-		log.Printf("[ERROR]: %v", err)
+	if err := us.Services.Stop(AgentServiceName); err != nil {
+		logger.Error("could not stop the openuem-agent service", "error", err)
 	}
 
 	SaveTaskInfoToINI(openuem_nats.UPDATE_SUCCESS, "")
-	log.Println("[INFO]: new OpenUEM Agent update command was called", downloadPath)
+	logger.Info("new OpenUEM Agent update command was called", "path", downloadPath)
 
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+	AckMessage(msg)
+
+	// The installer restarts the updater so this is the last event we can send
+	us.PublishUpdateStatus(requestID, UPDATE_PHASE_INSTALLING, nil, nil, "")
+
+	if err := us.Runner.Start(downloadPath, "/VERYSILENT"); err != nil {
+		logger.Error("could not run update command", "command", downloadPath, "error", err)
+		us.PublishUpdateStatus(requestID, UPDATE_PHASE_FAILED, nil, err, "")
+		return
 	}
+}
 
-	cmd := exec.Command(downloadPath, "/VERYSILENT")
-	err = cmd.Start()
+func LogDir() (string, error) {
+	// Logs are stored next to the executable
+	ex, err := os.Executable()
 	if err != nil {
-		log.Printf("[ERROR]: could not run %s command, reason: %v", downloadPath, err)
-		return
+		return "", err
 	}
+	return filepath.Join(filepath.Dir(ex), "logs"), nil
 }
 
-func UninstallAgent() error {
+// GetStateDir returns the directory where the updater keeps its state files,
+// in the agent's folder under ProgramData
+func GetStateDir() (string, error) {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		return "", errors.New("the ProgramData environment variable is not set")
+	}
+	return filepath.Join(programData, "OpenUEM Agent", "updater"), nil
+}
 
+// InstalledAgentVersion is not available as the installer doesn't register
+// the agent version, updates are always applied
+func (us *UpdaterService) InstalledAgentVersion() (string, error) {
+	return "", errors.ErrUnsupported
+}
+
+func (us *UpdaterService) UninstallAgent() error {
 	uninstallPath := "C:\\Program Files\\OpenUEM Agent\\unins000.exe"
-	cmd := exec.Command(uninstallPath, "/VERYSILENT")
-	err := cmd.Start()
-	if err != nil {
-		log.Printf("[ERROR]: could not run %s command, reason: %v", uninstallPath, err)
+	if err := us.Runner.Start(uninstallPath, "/VERYSILENT"); err != nil {
+		slog.Error("could not run uninstall command", "command", uninstallPath, "error", err)
 		return err
 	}
 	return nil
@@ -4,6 +4,7 @@ package main
 
 import (
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,13 +13,18 @@ import (
 )
 
 func main() {
-	us, err := common.NewUpdateService()
-	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %s", err.Error())
+	// The updater calls itself to run deferred install and uninstall jobs
+	if len(os.Args) == 3 && os.Args[1] == common.DeferredRunCommand {
+		if err := common.RunDeferredJob(os.Args[2]); err != nil {
+			log.Fatalf("[FATAL]: %v", err)
+		}
+		return
 	}
 
-	if err := us.ReadConfig(); err != nil {
-		log.Fatalf("[FATAL]: %v", err)
+	us, err := common.NewUpdateService()
+	if err != nil {
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 
 	us.StartService()
@@ -3,7 +3,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -14,11 +14,8 @@ import (
 func main() {
 	us, err := common.NewUpdateService()
 	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %s", err.Error())
-	}
-
-	if err := us.ReadConfig(); err != nil {
-		log.Fatalf("[FATAL]: %v", err)
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 
 	us.StartService()
@@ -3,7 +3,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 
@@ -15,24 +15,22 @@ import (
 func main() {
 	us, err := common.NewUpdateService()
 	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %s", err.Error())
-	}
-
-	if err := us.ReadConfig(); err != nil {
-		log.Fatalf("[FATAL]: %v", err)
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 
 	// Delete updates folder
 	cwd, err := openuem_utils.GetWd()
 	if err != nil {
-		log.Fatalf("[FATAL]: %v", err)
+		slog.Error("could not get working directory", "error", err)
+		os.Exit(1)
 	}
 
 	agentUpdatePath := filepath.Join(cwd, "updates", "agent-setup.exe")
 	_, err = os.Stat(agentUpdatePath)
 	if err == nil {
 		if err := os.Remove(agentUpdatePath); err != nil {
-			log.Println("[ERROR]: could not remove previous agent update")
+			slog.Error("could not remove previous agent update", "error", err)
 		}
 	}
 
@@ -43,6 +41,6 @@ func main() {
 	// Run service
 	err = svc.Run("openuem-agent-updater", ws)
 	if err != nil {
-		log.Printf("[ERROR]: could not run service: %v", err)
+		slog.Error("could not run service", "error", err)
 	}
 }